@@ -6,36 +6,129 @@ import (
 	"greactor/src/buffers"
 	"greactor/src/core/icodecs"
 	"greactor/src/core/netpoll"
+	"greactor/src/errors"
+	"greactor/src/socket"
 	"net"
 	"os"
+	"time"
 )
 
 type Conn interface {
 	Open(buf []byte) error
 
+	// 使用编解码器从入站缓冲区中解码出下一个完整的报文，缓冲区中没有完整的报文时返回(nil, nil)
 	Read() ([]byte, error)
 
+	// 连接已经关闭时返回ErrConnectionClosed
 	Write(buf []byte) (err error)
 
+	// 使用writev(2)一次性发送多块数据，避免把它们拼接成一个新的切片，没有发送完的数据会缓存在outboundBuffer中。
+	// 数据不会经过编解码器编码，直接原样发送，连接已经关闭时返回ErrConnectionClosed
+	Writev(bs [][]byte) (err error)
+
 	Close(err error) (rerr error)
+
+	// 本端地址
+	LocalAddr() net.Addr
+
+	// 对端地址
+	RemoteAddr() net.Addr
+
+	// 连接所属监听器监听的地址，服务器同时监听多个地址时可以用来区分连接的来源
+	ListenerAddr() net.Addr
+
+	// 连接所属event-loop的索引，和LoopInfo.Index相同。同一个event-loop上的连接在同一个协程中处理，
+	// 可以用它来访问按event-loop划分的数据而不需要加锁
+	LoopIndex() int
+
+	// 获取连接上绑定的用户自定义上下文，比如会话状态
+	Context() (ctx interface{})
+
+	// 在连接上绑定用户自定义上下文，连接关闭时会被清空
+	SetContext(ctx interface{})
+
+	// 以下方法直接操作入站缓冲区，用于Options.RawRead模式下在React中自己解析报文。
+
+	// 返回入站缓冲区中接下来的n个字节，但不消费它们，n<=0时返回缓冲区中的全部数据。
+	// 返回的切片直接引用缓冲区的内存，只在本次事件回调中有效
+	Peek(n int) (buf []byte, err error)
+
+	// 返回并消费入站缓冲区中接下来的n个字节，n<=0时返回缓冲区中的全部数据。
+	// 返回的切片直接引用缓冲区的内存，只在下一次从连接读取数据之前有效，需要保留时要自己拷贝
+	Next(n int) (buf []byte, err error)
+
+	// 丢弃入站缓冲区中接下来的n个字节，n<=0时丢弃全部数据，返回实际丢弃的字节数
+	Discard(n int) (discarded int, err error)
+
+	// 入站缓冲区中还没有被消费的字节数
+	InboundBuffered() int
+
+	// 以下线程安全的方法把任务投递到连接所属的event-loop中执行，event-loop已经退出时返回ErrServerShutdown。
+
+	// 线程安全，可以在其它协程中调用。把数据投递到连接所属的event-loop中发送，在数据发送之前不能修改buf，
+	// 发送完成后在event-loop中回调callback，callback可以为nil
+	AsyncWrite(buf []byte, callback AsyncCallback) error
+
+	// 线程安全，可以在其它协程中调用。唤醒连接所属的event-loop，并以nil报文回调React
+	Wake() error
+
+	// 线程安全，可以在其它协程中调用。经过d之后在连接所属的event-loop中执行fn，连接已经关闭时不再执行。
+	// 在其它协程中调用时定时器被投递到event-loop中加入，event-loop已经退出时返回的Timer不会执行，返回的Timer可以在任意协程中取消
+	AfterFunc(d time.Duration, fn func()) Timer
+
+	// 线程安全，可以在其它协程中调用。同时设置读超时和写超时，语义和net.Conn相同，t为零值时取消超时，对UDP连接无效。
+	// 在event-loop中调用时立即生效，在其它协程中调用时投递到event-loop中生效
+	SetDeadline(t time.Time) error
+
+	// 线程安全，可以在其它协程中调用。到达t时关闭连接，OnClosed收到的错误为os.ErrDeadlineExceeded，
+	// 需要继续读取数据时要重新设置，t为零值时取消超时
+	SetReadDeadline(t time.Time) error
+
+	// 线程安全，可以在其它协程中调用。到达t时outboundBuffer中还有没发送完的数据就关闭连接，
+	// OnClosed收到的错误为os.ErrDeadlineExceeded，之后调用Write会返回os.ErrDeadlineExceeded，t为零值时取消超时
+	SetWriteDeadline(t time.Time) error
 }
 
+// 异步写操作完成后的回调，在连接所属的event-loop中执行，err不为nil说明数据没有发送成功
+type AsyncCallback func(c Conn, err error)
+
+type asyncWriteHook struct {
+	callback AsyncCallback
+	data     []byte
+}
+
+type deadlineHook struct {
+	t           time.Time
+	read, write bool
+}
+
+// 单次writev(2)调用最多能发送的数据块数量，也就是IOV_MAX
+const maxIovNum = 1024
+
 type conn struct {
 	fd             int
 	ctx            interface{}
-	peer           unix.Sockaddr
+	peer           unix.Sockaddr // UDP连接对端的地址
+	isDatagram     bool          // 是否是UDP连接
 	loop           *eventLoop
 	codec          icodecs.ICodec
-	buffer         []byte
 	opened         bool
 	localAddr      net.Addr
 	remoteAddr     net.Addr
+	listenerAddr   net.Addr
 	inboundBuffer  *buffers.ByteBuffer
 	outboundBuffer *buffers.ByteBuffer
 	pollAttachment *netpoll.PollAttachment
+	lastRead       time.Time // 最后一次读到数据的时间，用于空闲检测
+	lastWrite      time.Time // 最后一次写出数据的时间，用于空闲检测
+	readDeadline   time.Time
+	writeDeadline  time.Time
+	readTimer      Timer
+	writeTimer     Timer
+	quickAck       bool // 是否在每次读取数据之后重新开启TCP_QUICKACK
 }
 
-func newTCPConn(fd int, el *eventLoop, sa unix.Sockaddr, codec icodecs.ICodec, localAddr, remoteAddr net.Addr) (c *conn) {
+func newTCPConn(fd int, el *eventLoop, ln *listener, sa unix.Sockaddr, codec icodecs.ICodec, localAddr, remoteAddr net.Addr) (c *conn) {
 	c = &conn{
 		fd:             fd,
 		peer:           sa,
@@ -43,19 +136,37 @@ func newTCPConn(fd int, el *eventLoop, sa unix.Sockaddr, codec icodecs.ICodec, l
 		codec:          codec,
 		localAddr:      localAddr,
 		remoteAddr:     remoteAddr,
+		listenerAddr:   ln.saddr.NetAddr,
+		quickAck:       ln.quickAck,
 		inboundBuffer:  buffers.GetByteBuffer(),
 		outboundBuffer: buffers.GetByteBuffer(),
 	}
-	c.buffer = make([]byte, DefaultBufferSize)
 	c.pollAttachment = netpoll.GetPollAttachment()
 	c.pollAttachment.FD, c.pollAttachment.Callback = fd, c.handleEvents
 	return
 }
 
+// UDP没有真正的连接，每收到一个数据报就创建一个conn代表发送方，向它写数据就是把数据报发回给发送方。
+// UDP的数据报不经过编解码器，直接原样收发
+func newUDPConn(fd int, el *eventLoop, localAddr net.Addr, sa unix.Sockaddr) *conn {
+	return &conn{
+		fd:             fd,
+		peer:           sa,
+		loop:           el,
+		opened:         true,
+		isDatagram:     true,
+		localAddr:      localAddr,
+		remoteAddr:     socket.SockaddrToUDPAddr(sa),
+		listenerAddr:   localAddr,
+		inboundBuffer:  new(buffers.ByteBuffer),
+		outboundBuffer: new(buffers.ByteBuffer),
+	}
+}
+
 func (c *conn) handleEvents(_ int, ev uint32) error {
 	fmt.Println("开始处理事件")
 	if ev&netpoll.OutEvents != 0 && !c.outboundBuffer.IsEmpty() {
-		if err := c.loop.write(c, nil); err != nil {
+		if err := c.loop.flush(c); err != nil {
 			return err
 		}
 	}
@@ -72,6 +183,12 @@ func (c *conn) Close(err error) (rerr error) {
 		return nil
 	}
 
+	// UDP连接和监听器共用同一个socket，不能关闭它
+	if c.isDatagram {
+		c.opened = false
+		return nil
+	}
+
 	if c.outboundBuffer.IsNotEmpty() {
 		c.outboundBuffer.Reset()
 	}
@@ -82,48 +199,245 @@ func (c *conn) Close(err error) (rerr error) {
 	}
 	if err1 != nil {
 		err1 = fmt.Errorf("failed to close fd=%d in event-loop(%d): %v", c.fd, c.loop.idx, os.NewSyscallError("close", err1))
+		if rerr == nil {
+			rerr = err1
+		}
 	}
+	delete(c.loop.connections, c.fd)
 	c.loop.addConn(-1)
 
 	c.releaseTCP()
-	return nil
+
+	// 排空阶段最后一个连接可能是在React、OnTick或者定时器中被用户代码关闭的，
+	// 这里没办法把ErrServerShutdown交给event-loop，投递一个任务让它检查排空是否已经完成
+	if c.loop.draining && len(c.loop.connections) == 0 {
+		_ = c.loop.trigger(func(_ interface{}) error { return c.loop.checkDrained() }, nil)
+	}
+	return
 }
 
 func (c *conn) releaseTCP() {
 	c.opened = false
 	c.peer = nil
 	c.ctx = nil
-	c.buffer = nil
 
 	c.localAddr = nil
 	c.remoteAddr = nil
+	c.listenerAddr = nil
 	buffers.PutByteBuffer(c.inboundBuffer)
 	buffers.PutByteBuffer(c.outboundBuffer)
 	netpoll.PutPollAttachment(c.pollAttachment)
 	c.pollAttachment = nil
 }
 
-func (c *conn) Read() ([]byte, error) {
-	fmt.Printf("cap:%d", cap(c.buffer))
-	n, err := unix.Read(c.fd, c.buffer)
-	if n == 0 || err != nil {
-		if err == unix.EAGAIN {
-			return nil, nil
+func (c *conn) LocalAddr() net.Addr { return c.localAddr }
+
+func (c *conn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *conn) ListenerAddr() net.Addr { return c.listenerAddr }
+
+func (c *conn) LoopIndex() int { return c.loop.idx }
+
+func (c *conn) Context() interface{} { return c.ctx }
+
+func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
+
+func (c *conn) Peek(n int) ([]byte, error) {
+	inBufferLen := c.inboundBuffer.Len()
+	if n <= 0 {
+		n = inBufferLen
+	}
+	if n > inBufferLen {
+		return nil, errors.ErrUnexpectedEOF
+	}
+	// 限制切片的容量，调用方append时不会覆盖缓冲区中后面的数据
+	b := c.inboundBuffer.Bytes()
+	return b[:n:n], nil
+}
+
+func (c *conn) Next(n int) (buf []byte, err error) {
+	if buf, err = c.Peek(n); err != nil {
+		return
+	}
+	c.inboundBuffer.ShiftN(len(buf))
+	return
+}
+
+func (c *conn) Discard(n int) (int, error) {
+	inBufferLen := c.inboundBuffer.Len()
+	if n <= 0 || n > inBufferLen {
+		n = inBufferLen
+	}
+	c.inboundBuffer.ShiftN(n)
+	return n, nil
+}
+
+func (c *conn) InboundBuffered() int {
+	return c.inboundBuffer.Len()
+}
+
+func (c *conn) AsyncWrite(buf []byte, callback AsyncCallback) error {
+	return c.loop.trigger(c.asyncWrite, &asyncWriteHook{callback: callback, data: buf})
+}
+
+// 在event-loop中执行异步写任务
+func (c *conn) asyncWrite(itf interface{}) (err error) {
+	hook := itf.(*asyncWriteHook)
+	// UDP连接没有状态，只要知道对端地址就可以发送数据报
+	if c.isDatagram {
+		err = c.sendTo(hook.data)
+		if hook.callback != nil {
+			hook.callback(c, err)
+		}
+		return nil
+	}
+	if !c.opened {
+		if hook.callback != nil {
+			hook.callback(c, errors.ErrConnectionClosed)
+		}
+		return nil
+	}
+
+	err = c.loop.write(c, hook.data)
+	if hook.callback != nil {
+		cbErr := err
+		if cbErr == nil && !c.opened {
+			cbErr = errors.ErrConnectionClosed
 		}
+		hook.callback(c, cbErr)
+	}
+	return
+}
+
+func (c *conn) Wake() error {
+	return c.loop.trigger(c.loop.wake, c)
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.applyDeadline(&deadlineHook{t: t, read: true, write: true})
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return c.applyDeadline(&deadlineHook{t: t, read: true})
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return c.applyDeadline(&deadlineHook{t: t, write: true})
+}
+
+// 在event-loop中调用时直接设置，同一个回调中之后的Write就能看到新的超时；在其它协程中调用时投递到event-loop中设置
+func (c *conn) applyDeadline(hook *deadlineHook) error {
+	if c.loop.inLoop() {
+		return c.setDeadline(hook)
+	}
+	return c.loop.trigger(c.setDeadline, hook)
+}
+
+// 在event-loop中设置超时时间，替换掉之前的定时器
+func (c *conn) setDeadline(itf interface{}) error {
+	hook := itf.(*deadlineHook)
+	if !c.opened || c.isDatagram {
+		return nil
+	}
+	if hook.read {
+		c.readDeadline = hook.t
+		c.readTimer = c.resetDeadlineTimer(c.readTimer, hook.t, func() error {
+			return c.loop.closeOnTimeout(c, os.ErrDeadlineExceeded)
+		})
+	}
+	if hook.write {
+		c.writeDeadline = hook.t
+		c.writeTimer = c.resetDeadlineTimer(c.writeTimer, hook.t, func() error {
+			if c.outboundBuffer.IsNotEmpty() {
+				return c.loop.closeOnTimeout(c, os.ErrDeadlineExceeded)
+			}
+			return nil
+		})
+	}
+	return nil
+}
 
-		fmt.Printf("read_err: %v，n:%d\n", err, n)
-		return nil, c.Close(os.NewSyscallError("read", err))
+func (c *conn) resetDeadlineTimer(old Timer, t time.Time, fn func() error) Timer {
+	if old != nil {
+		old.Stop()
 	}
-	c.buffer = c.buffer[:n]
-	c.inboundBuffer.Append(c.buffer)
-	// 进行解码
-	data, err := c.codec.Decode(c.inboundBuffer.Bytes())
-	if err != nil {
-		return nil, err
+	if t.IsZero() {
+		return nil
 	}
+	return c.afterFunc(time.Until(t), fn)
+}
 
-	c.inboundBuffer.ShiftN(len(data))
-	return data, nil
+func (c *conn) writeDeadlineExceeded() bool {
+	return !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline)
+}
+
+func (c *conn) AfterFunc(d time.Duration, fn func()) Timer {
+	wrapped := func() error {
+		fn()
+		return nil
+	}
+	if c.loop.inLoop() {
+		return c.afterFunc(d, wrapped)
+	}
+	// 时间轮只能在event-loop中访问，先创建定时器，再投递到event-loop中加入时间轮，到期时间从现在开始计算
+	t := &timer{fn: c.timerFunc(wrapped)}
+	at := time.Now().Add(d)
+	if err := c.loop.trigger(c.scheduleTimer, &timerHook{t: t, at: at}); err != nil {
+		// event-loop已经退出，定时器永远不会执行
+		t.state = timerStopped
+	}
+	return t
+}
+
+type timerHook struct {
+	t  *timer
+	at time.Time
+}
+
+func (c *conn) scheduleTimer(itf interface{}) error {
+	hook := itf.(*timerHook)
+	now := time.Now()
+	c.loop.timers.schedule(now, hook.at.Sub(now), hook.t)
+	return nil
+}
+
+// 框架内部使用的定时器，fn返回的错误会交给event-loop处理
+func (c *conn) afterFunc(d time.Duration, fn func() error) Timer {
+	return c.loop.timers.add(time.Now(), d, c.timerFunc(fn))
+}
+
+// 连接关闭后不再执行定时器的回调
+func (c *conn) timerFunc(fn func() error) func() error {
+	return func() error {
+		if !c.opened {
+			return nil
+		}
+		return fn()
+	}
+}
+
+func (c *conn) Read() ([]byte, error) {
+	for c.inboundBuffer.IsNotEmpty() {
+		frame, n, err := c.codec.Decode(c.inboundBuffer.Bytes())
+		if err == errors.ErrIncompletePacket {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 编解码器没有消费任何数据，说明需要等待更多的数据
+		if n <= 0 {
+			return nil, nil
+		}
+
+		c.inboundBuffer.ShiftN(n)
+		// 编解码器可能只是跳过了一些无用的数据，没有解出报文，继续解码
+		if frame != nil {
+			// 报文直接引用缓冲区的内存，限制它的容量，防止使用者append时覆盖缓冲区中后面的数据
+			return frame[:len(frame):len(frame)], nil
+		}
+	}
+	return nil, nil
 }
 
 func (c *conn) Open(buf []byte) (err error) {
@@ -135,11 +449,27 @@ func (c *conn) Open(buf []byte) (err error) {
 }
 
 func (c *conn) Write(buf []byte) (err error) {
+	// 连接关闭后缓冲区已经归还到池中，fd也可能已经被复用，不能再写
+	if !c.opened {
+		return errors.ErrConnectionClosed
+	}
 
-	c.outboundBuffer.Append(buf)
+	if c.isDatagram {
+		return c.sendTo(buf)
+	}
+
+	if c.writeDeadlineExceeded() {
+		return os.ErrDeadlineExceeded
+	}
 
 	var packet []byte
-	if packet, err = c.codec.Encode(c.outboundBuffer.Bytes()); err != nil {
+	if packet, err = c.codec.Encode(buf); err != nil {
+		return
+	}
+
+	// 缓冲区中还有没发送完的数据，为了保证数据的顺序，只能追加到缓冲区末尾，等待写事件就绪后再发送
+	if c.outboundBuffer.IsNotEmpty() {
+		c.outboundBuffer.Append(packet)
 		return
 	}
 
@@ -152,14 +482,95 @@ func (c *conn) Write(buf []byte) (err error) {
 			err = c.loop.poller.ModReadWrite(c.pollAttachment)
 			return
 		}
-		return c.Close(err)
+		return
 	}
+	c.lastWrite = time.Now()
 
-	c.outboundBuffer.ShiftN(n)
 	if n < len(packet) {
+		c.outboundBuffer.Append(packet[n:])
+		// 让轮询器 监听写事件就绪
+		err = c.loop.poller.ModReadWrite(c.pollAttachment)
+	}
+	return
+}
+
+func (c *conn) Writev(bs [][]byte) (err error) {
+	if !c.opened {
+		return errors.ErrConnectionClosed
+	}
+
+	// UDP需要把所有的数据块放在同一个数据报中发送
+	if c.isDatagram {
+		var packet []byte
+		for _, b := range bs {
+			packet = append(packet, b...)
+		}
+		return c.sendTo(packet)
+	}
+
+	if c.writeDeadlineExceeded() {
+		return os.ErrDeadlineExceeded
+	}
+
+	// 缓冲区中还有没发送完的数据，为了保证数据的顺序，只能追加到缓冲区末尾
+	if c.outboundBuffer.IsNotEmpty() {
+		for _, b := range bs {
+			c.outboundBuffer.Append(b)
+		}
+		return
+	}
+
+	// 单次writev最多只能发送maxIovNum块数据，剩下的留到写事件就绪时再发送
+	iovs := bs
+	if len(iovs) > maxIovNum {
+		iovs = iovs[:maxIovNum]
+	}
+
+	var n int
+	if n, err = unix.Writev(c.fd, iovs); err != nil {
+		if err != unix.EAGAIN {
+			return
+		}
+		n, err = 0, nil
+	}
+	if n > 0 {
+		c.lastWrite = time.Now()
+	}
+
+	// 把没有发送完的数据追加到outboundBuffer中
+	for _, b := range bs {
+		if n >= len(b) {
+			n -= len(b)
+			continue
+		}
+		c.outboundBuffer.Append(b[n:])
+		n = 0
+	}
+
+	if c.outboundBuffer.IsNotEmpty() {
 		// 让轮询器 监听写事件就绪
 		err = c.loop.poller.ModReadWrite(c.pollAttachment)
 	}
+	return
+}
+
+// 把数据报发回给UDP连接的对端
+func (c *conn) sendTo(buf []byte) error {
+	return os.NewSyscallError("sendto", unix.Sendto(c.fd, buf, 0, c.peer))
+}
+
+// 将outboundBuffer中积压的数据写入socket，全部写完后轮询器不再监听写事件
+func (c *conn) flush() (err error) {
+	var n int
+	if n, err = unix.Write(c.fd, c.outboundBuffer.Bytes()); err != nil {
+		if err == unix.EAGAIN {
+			return nil
+		}
+		return
+	}
+	c.lastWrite = time.Now()
+
+	c.outboundBuffer.ShiftN(n)
 	if c.outboundBuffer.IsEmpty() {
 		err = c.loop.poller.ModRead(c.pollAttachment)
 	}
@@ -0,0 +1,28 @@
+package core
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// 获取当前进程允许使用的CPU编号
+func allowedCPUs() ([]int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, os.NewSyscallError("sched_getaffinity", err)
+	}
+	var cpus []int
+	for i := 0; i < len(set)*64 && len(cpus) < set.Count(); i++ {
+		if set.IsSet(i) {
+			cpus = append(cpus, i)
+		}
+	}
+	return cpus, nil
+}
+
+// 把当前的系统线程绑定到cpu上，调用之前必须先执行runtime.LockOSThread
+func pinThreadToCPU(cpu int) error {
+	var set unix.CPUSet
+	set.Set(cpu)
+	return os.NewSyscallError("sched_setaffinity", unix.SchedSetaffinity(0, &set))
+}
@@ -1,30 +1,52 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
 	"golang.org/x/sys/unix"
 	"greactor/src/core/netpoll"
+	"greactor/src/core/queue"
 	"greactor/src/errors"
+	"greactor/src/socket"
 	"os"
+	"runtime"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type eventLoop struct {
-	ln *listener // listener
+	listeners map[int]*listener // 直接注册在这个event-loop上的监听器，key为监听器的fd
 	// 在事件循环线程组中的索引
 	idx          int
+	cpu          int // 绑定的CPU，为-1时不绑定
 	svr          *Server
 	poller       *netpoll.Poller
 	buffer       []byte
 	connCount    int32
+	pending      int32        // 主reactor已经分配给它、但还没有注册完成的连接数
+	draining     bool         // 是否处于关闭前的排空阶段
+	timers       *timingWheel // 连接上的定时器
+	ticking      bool         // 是否由这个event-loop调用OnTick
+	nextTick     time.Time    // 下一次调用OnTick的时间
 	connections  map[int]*conn
 	eventHandler EventHandler
+	closeMu      sync.RWMutex
+	closed       bool   // event-loop已经退出，不再执行投递过来的任务
+	gid          uint64 // 运行事件循环的协程id，用来判断调用方是否在event-loop中
 }
 
 func (el *eventLoop) activateMainReactor() {
+	atomic.StoreUint64(&el.gid, goroutineID())
+	if el.svr.lockOSThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
 	defer el.svr.signalShutdown()
 
-	err := el.poller.Polling(func(fd int, ev uint32) error { return el.svr.accept(fd, ev) })
+	err := el.poller.Polling(el.accept)
 	if err == errors.ErrServerShutdown {
 		fmt.Printf("main reactor is exiting in terms of the demand from user, %v", err)
 	} else if err != nil {
@@ -33,21 +55,53 @@ func (el *eventLoop) activateMainReactor() {
 }
 
 func (el *eventLoop) activateSubReactor() {
+	atomic.StoreUint64(&el.gid, goroutineID())
+	if el.svr.lockOSThread {
+		runtime.LockOSThread()
+		// 绑定过CPU的线程不再交还给Go运行时，goroutine退出时线程随之退出
+		if el.cpu < 0 {
+			defer runtime.UnlockOSThread()
+		} else if err := pinThreadToCPU(el.cpu); err != nil {
+			fmt.Printf("event-loop:%d failed to pin to cpu %d: %v\n", el.idx, el.cpu, err)
+		}
+	}
+
 	defer func() {
+		el.markClosed()
 		el.closeAllSockets()
+		el.discardAccepted()
 		el.svr.signalShutdown()
 	}()
 
 	err := el.poller.Polling(func(fd int, ev uint32) error {
 		if c, ack := el.connections[fd]; ack {
 			if ev&netpoll.OutEvents != 0 && !c.outboundBuffer.IsEmpty() {
-				if err := el.write(c, []byte{}); err != nil {
+				if err := el.flush(c); err != nil {
 					return err
 				}
+				// 发送失败时连接已经被关闭，fd可能已经被复用，不能再读取
+				if !c.opened {
+					if el.draining {
+						return el.checkDrained()
+					}
+					return nil
+				}
+			}
+			// 排空阶段不再读取新的请求，只等待积压的数据发送完毕
+			if el.draining {
+				if c.opened && c.outboundBuffer.IsEmpty() {
+					_ = el.closeConn(c, nil)
+				}
+				return el.checkDrained()
 			}
 			if ev&netpoll.InEvents != 0 && (ev&netpoll.OutEvents == 0 || c.outboundBuffer.IsEmpty()) {
 				return el.read(c)
 			}
+		} else if ln, ok := el.listeners[fd]; ok {
+			if ln.isUDP() {
+				return el.readUDP(ln)
+			}
+			return el.accept(fd, ev)
 		}
 		return nil
 	})
@@ -59,13 +113,104 @@ func (el *eventLoop) activateSubReactor() {
 	}
 }
 
+// 主reactor接收新连接，通过负载均衡算法选出一个event-loop，把新连接投递给它。
+// SO_REUSEPORT模式下由event-loop自己接收新连接，直接注册到自己身上
+func (el *eventLoop) accept(fd int, _ IOEvent) error {
+	ln, ok := el.listeners[fd]
+	if !ok {
+		return nil
+	}
+
+	nfd, sa, err := unix.Accept(fd)
+	if err != nil {
+		if err == unix.EAGAIN {
+			return nil
+		}
+		fmt.Printf("Accept() fails due to error: %v", err)
+		// ReusePort模式下每个event-loop都有自己的监听器，暂时性的错误不应该让整个服务器退出
+		if el.idx >= 0 && isTransientAcceptError(err) {
+			return nil
+		}
+		return errors.ErrAcceptSocket
+	}
+	if err = os.NewSyscallError("fcntl nonblock", unix.SetNonblock(nfd, true)); err != nil {
+		return err
+	}
+	if err = ln.setConnSockOpts(nfd); err != nil {
+		fmt.Printf("failed to set socket options on fd=%d: %v\n", nfd, err)
+		_ = unix.Close(nfd)
+		return nil
+	}
+
+	remoteAddr := socket.SockaddrToTCPOrUnixAddr(sa)
+	// 连接的本端地址，监听在通配地址上时可以得到连接实际使用的地址
+	localAddr := ln.saddr.NetAddr
+	if lsa, err := unix.Getsockname(nfd); err == nil {
+		if addr := socket.SockaddrToTCPOrUnixAddr(lsa); addr != nil {
+			localAddr = addr
+		}
+	}
+
+	if el.idx >= 0 {
+		return el.register(newTCPConn(nfd, el, ln, sa, el.svr.opts.Codec, localAddr, remoteAddr))
+	}
+
+	sel := el.svr.lb.next(remoteAddr)
+	c := newTCPConn(nfd, sel, ln, sa, el.svr.opts.Codec, localAddr, remoteAddr)
+
+	// 在投递之前计入选中的event-loop，后续的连接选择event-loop时就能看到它
+	atomic.AddInt32(&sel.pending, 1)
+	err = sel.trigger(sel.registerAccepted, (*acceptedConn)(c))
+	if err != nil {
+		atomic.AddInt32(&sel.pending, -1)
+		_ = unix.Close(nfd)
+		c.releaseTCP()
+	}
+	return nil
+}
+
+// accept(2)返回的暂时性错误：文件描述符或者内存暂时耗尽、连接在accept之前被对端重置、被信号中断，
+// 之后再次accept可能会成功
+func isTransientAcceptError(err error) bool {
+	switch err {
+	case unix.EMFILE, unix.ENFILE, unix.ENOBUFS, unix.ENOMEM, unix.ECONNABORTED, unix.EINTR, unix.EPROTO, unix.EPERM:
+		return true
+	}
+	return false
+}
+
 func (el *eventLoop) closeAllSockets() {
 	// Close loops and all outstanding connections
 	for _, c := range el.connections {
+		// 关闭连接之前尽量把还没发送完的数据写出去
+		if c.outboundBuffer.IsNotEmpty() {
+			_ = c.flush()
+		}
 		_ = el.closeConn(c, nil)
 	}
 }
 
+// 进入关闭前的排空阶段：没有待发送数据的连接直接关闭，其余连接只监听写事件，等数据全部发送完毕后再关闭
+func (el *eventLoop) drain(_ interface{}) error {
+	el.draining = true
+	for _, c := range el.connections {
+		if c.outboundBuffer.IsEmpty() {
+			_ = el.closeConn(c, nil)
+		} else if err := el.poller.ModWrite(c.pollAttachment); err != nil {
+			_ = el.closeConn(c, err)
+		}
+	}
+	return el.checkDrained()
+}
+
+// 所有连接都已经关闭，排空阶段结束，退出事件循环
+func (el *eventLoop) checkDrained() error {
+	if len(el.connections) == 0 {
+		return errors.ErrServerShutdown
+	}
+	return nil
+}
+
 func (el *eventLoop) closeConn(c *conn, err error) (rerr error) {
 	fmt.Println(err)
 	rerr = c.Close(err)
@@ -88,43 +233,198 @@ func (el *eventLoop) write(c *conn, buf []byte) (err error) {
 	case unix.EAGAIN:
 		return nil
 	default:
-		return el.closeConn(c, os.NewSyscallError("write", err))
+		return el.closeConn(c, writeError(err))
 	}
+	return
+}
 
-	if c.outboundBuffer.IsEmpty() {
-		_ = el.poller.ModRead(c.pollAttachment)
+// 写超时的错误原样交给OnClosed，和SetWriteDeadline的文档保持一致，其它错误包装成系统调用错误
+func writeError(err error) error {
+	if err == os.ErrDeadlineExceeded {
+		return err
 	}
+	return os.NewSyscallError("write", err)
+}
 
-	return
+// 写事件就绪，把连接积压在outboundBuffer中的数据发送出去
+func (el *eventLoop) flush(c *conn) error {
+	if err := c.flush(); err != nil {
+		return el.closeConn(c, writeError(err))
+	}
+	return nil
 }
 
-func (el *eventLoop) read(c *conn) (err error) {
-	for packet, _ := c.Read(); packet != nil; packet, _ = c.Read() {
-		out, action := el.eventHandler.React(packet, c)
-		if out != nil {
-			if err = el.write(c, out); err != nil {
-				return err
-			}
-		}
-		switch action {
-		case None:
-		case Close:
-			return el.closeConn(c, nil)
-		case Shutdown:
-			return errors.ErrServerShutdown
+func (el *eventLoop) read(c *conn) error {
+	n, err := unix.Read(c.fd, el.buffer)
+	if err != nil || n == 0 {
+		if err == unix.EAGAIN {
+			return nil
 		}
+		return el.closeConn(c, os.NewSyscallError("read", err))
+	}
+	c.lastRead = time.Now()
+	c.inboundBuffer.Append(el.buffer[:n])
+	if c.quickAck {
+		_ = socket.SetQuickAck(c.fd, 1)
+	}
 
+	// 原始读取模式下把缓冲区中的数据原样交给React，由React自己消费
+	if el.svr.opts.RawRead {
+		return el.react(c, c.inboundBuffer.Bytes())
+	}
+
+	// 一次读取到的数据中可能包含多个完整的报文，全部处理完之后再回到epoll
+	for {
+		packet, err := c.Read()
+		if err != nil {
+			return el.closeConn(c, err)
+		}
+		if packet == nil {
+			return nil
+		}
+		if err = el.react(c, packet); err != nil {
+			return err
+		}
 		if !c.opened {
 			return nil
 		}
 	}
-	return
+}
+
+// 回调React，写出React返回的数据并处理它返回的action
+func (el *eventLoop) react(c *conn, packet []byte) error {
+	out, action := el.eventHandler.React(packet, c)
+	if out != nil {
+		if err := el.write(c, out); err != nil {
+			return err
+		}
+	}
+	switch action {
+	case None:
+	case Close:
+		return el.closeConn(c, nil)
+	case Shutdown:
+		return errors.ErrServerShutdown
+	}
+	return nil
+}
+
+// 从UDP socket中读取一个数据报，每个数据报都会回调一次React，React返回的数据会作为数据报发回给发送方
+func (el *eventLoop) readUDP(ln *listener) error {
+	fd := ln.fd
+	n, sa, err := unix.Recvfrom(fd, el.buffer, 0)
+	if err != nil {
+		if err == unix.EAGAIN {
+			return nil
+		}
+		fmt.Printf("failed to read UDP packet from fd=%d in event-loop(%d): %v\n", fd, el.idx, os.NewSyscallError("recvfrom", err))
+		return nil
+	}
+
+	c := newUDPConn(fd, el, ln.saddr.NetAddr, sa)
+	out, action := el.eventHandler.React(el.buffer[:n:n], c)
+	if out != nil {
+		el.eventHandler.PreWrite(c)
+		_ = c.sendTo(out)
+		el.eventHandler.AfterWrite(c, out)
+	}
+	// UDP没有连接可以关闭，Close和None一样处理
+	if action == Shutdown {
+		return errors.ErrServerShutdown
+	}
+	return nil
+}
+
+// 在event-loop中处理Conn.Wake()发起的唤醒，以nil报文回调React
+func (el *eventLoop) wake(itf interface{}) error {
+	c := itf.(*conn)
+	if !c.opened {
+		return nil
+	}
+
+	out, action := el.eventHandler.React(nil, c)
+	if out != nil {
+		if err := el.write(c, out); err != nil {
+			return err
+		}
+	}
+	if !c.opened {
+		return nil
+	}
+	return el.handleAction(c, action)
+}
+
+// 在其它协程中向event-loop投递任务，event-loop已经退出时返回ErrServerShutdown，
+// 避免任务没有被执行，或者向已经关闭甚至被重新使用的eventfd写入数据
+func (el *eventLoop) trigger(fn queue.TaskFunc, arg interface{}) error {
+	el.closeMu.RLock()
+	defer el.closeMu.RUnlock()
+	if el.closed {
+		return errors.ErrServerShutdown
+	}
+	return el.poller.Trigger(fn, arg)
+}
+
+// 标记event-loop已经退出，之后投递的任务都会被拒绝
+func (el *eventLoop) markClosed() {
+	el.closeMu.Lock()
+	el.closed = true
+	el.closeMu.Unlock()
+}
+
+// 调用方是否运行在这个event-loop的协程中，是的话可以直接访问event-loop的数据而不需要投递任务
+func (el *eventLoop) inLoop() bool {
+	return atomic.LoadUint64(&el.gid) == goroutineID()
+}
+
+// 当前协程的id，从runtime.Stack输出的第一行"goroutine 18 [running]:"中解析出来
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// Index 实现LoopInfo
+func (el *eventLoop) Index() int {
+	return el.idx
+}
+
+// ConnCount 实现LoopInfo，包括已经分配给它但还没有注册完成的连接，
+// 否则大量连接同时到达时，负载均衡器在它们注册完成之前看到的都是同一个连接数最少的event-loop
+func (el *eventLoop) ConnCount() int {
+	return int(atomic.LoadInt32(&el.connCount) + atomic.LoadInt32(&el.pending))
 }
 
 func (el *eventLoop) addConn(delta int32) {
 	atomic.AddInt32(&el.connCount, delta)
 }
 
+// 主reactor投递给sub-reactor注册的新连接，和其它以*conn为参数的任务区分开，
+// event-loop退出时任务队列中还没有注册的新连接需要关闭fd
+type acceptedConn conn
+
+// 注册主reactor投递过来的新连接，无论注册是否成功都不再计入pending
+func (el *eventLoop) registerAccepted(itf interface{}) error {
+	defer atomic.AddInt32(&el.pending, -1)
+	return el.register((*conn)(itf.(*acceptedConn)))
+}
+
+// event-loop退出之后不会再执行任务队列中的任务，关闭还没来得及注册的新连接
+func (el *eventLoop) discardAccepted() {
+	el.poller.DiscardTasks(func(arg interface{}) {
+		if ac, ok := arg.(*acceptedConn); ok {
+			c := (*conn)(ac)
+			_ = unix.Close(c.fd)
+			c.releaseTCP()
+			atomic.AddInt32(&el.pending, -1)
+		}
+	})
+}
+
 func (el *eventLoop) register(itf interface{}) error {
 	fmt.Println("开始注册新连接")
 	c := itf.(*conn)
@@ -140,6 +440,7 @@ func (el *eventLoop) register(itf interface{}) error {
 func (el *eventLoop) open(c *conn) error {
 	c.opened = true
 	el.addConn(1)
+	el.startIdleCheck(c)
 
 	out, action := el.eventHandler.OnOpened(c)
 	if out != nil {
@@ -157,6 +458,89 @@ func (el *eventLoop) open(c *conn) error {
 	return el.handleAction(c, action)
 }
 
+// 配置了空闲超时时，在连接上启动空闲检测的定时器
+func (el *eventLoop) startIdleCheck(c *conn) {
+	opts := el.svr.opts
+	if opts.IdleTimeout <= 0 && opts.ReadIdleTimeout <= 0 && opts.WriteIdleTimeout <= 0 {
+		return
+	}
+	now := time.Now()
+	c.lastRead, c.lastWrite = now, now
+	_ = el.checkIdle(c, now)
+}
+
+// 检查连接是否空闲超时，超时就关闭连接，否则在最早可能超时的时刻再检查一次。
+// 每个连接只有一个定时器，读写数据时只需要更新时间，不需要重置定时器
+func (el *eventLoop) checkIdle(c *conn, now time.Time) error {
+	next := time.Duration(-1)
+	expired := func(timeout time.Duration, last time.Time) bool {
+		if timeout <= 0 {
+			return false
+		}
+		remain := timeout - now.Sub(last)
+		if remain <= 0 {
+			return true
+		}
+		if next < 0 || remain < next {
+			next = remain
+		}
+		return false
+	}
+
+	lastActive := c.lastRead
+	if c.lastWrite.After(lastActive) {
+		lastActive = c.lastWrite
+	}
+	opts := el.svr.opts
+	if expired(opts.IdleTimeout, lastActive) || expired(opts.ReadIdleTimeout, c.lastRead) || expired(opts.WriteIdleTimeout, c.lastWrite) {
+		return el.closeOnTimeout(c, errors.ErrIdleTimeout)
+	}
+	c.afterFunc(next, func() error { return el.checkIdle(c, time.Now()) })
+	return nil
+}
+
+// 定时器到期时关闭连接，排空阶段关闭的是最后一个连接时退出事件循环
+func (el *eventLoop) closeOnTimeout(c *conn, err error) error {
+	if err = el.closeConn(c, err); err != nil || !el.draining {
+		return err
+	}
+	return el.checkDrained()
+}
+
+// 轮询器的定时回调，执行到期的定时任务，返回距离下一个定时任务到期的时长
+func (el *eventLoop) handleTimers() (time.Duration, error) {
+	now := time.Now()
+	delay, err := el.timers.advance(now)
+	if err != nil {
+		return 0, err
+	}
+	if el.ticking {
+		d, err := el.tick(now)
+		if err != nil {
+			return 0, err
+		}
+		if delay < 0 || d < delay {
+			delay = d
+		}
+	}
+	return delay, nil
+}
+
+func (el *eventLoop) tick(now time.Time) (time.Duration, error) {
+	if now.Before(el.nextTick) {
+		return el.nextTick.Sub(now), nil
+	}
+	delay, action := el.eventHandler.OnTick()
+	if action == Shutdown {
+		return 0, errors.ErrServerShutdown
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	el.nextTick = now.Add(delay)
+	return delay, nil
+}
+
 func (el *eventLoop) handleAction(c *conn, action Action) error {
 	switch action {
 	case None:
@@ -1,5 +1,7 @@
 package core
 
+import "time"
+
 type IOEvent = uint32
 
 // 当事件处理完成后，需要进行的动作
@@ -31,4 +33,9 @@ type EventHandler interface {
 	AfterWrite(c Conn, b []byte)
 
 	React(packet []byte, c Conn) (out []byte, action Action)
+
+	// 开启Options.Ticker后，服务器启动时调用一次，之后每隔delay调用一次。
+	// 在第一个event-loop的线程中执行，可以安全地操作这个event-loop上的连接，返回Shutdown时关闭服务器。
+	// 在回调之间保存的连接可能已经被关闭，此时Write等方法返回ErrConnectionClosed
+	OnTick() (delay time.Duration, action Action)
 }
@@ -0,0 +1,91 @@
+package icodecs
+
+import (
+	"bytes"
+	"greactor/src/errors"
+)
+
+type (
+	// 基于分隔符的编解码器，分隔符可以是单个字节，也可以是一串字节
+	DelimiterBasedFrameCodec struct {
+		delimiter      []byte
+		maxFrameLength int
+		stripDelimiter bool
+	}
+
+	// 基于行的编解码器，同时支持以"\n"和"\r\n"结尾的行，编码时以"\r\n"结尾
+	LineBasedFrameCodec struct {
+		maxFrameLength int
+		stripDelimiter bool
+	}
+)
+
+var crlf = []byte("\r\n")
+
+// maxFrameLength是不包含分隔符的报文最大长度，为0时不做限制；stripDelimiter表示解码出来的报文是否去掉分隔符。
+// 分隔符不能为空，否则panic
+func NewDelimiterBasedFrameCodec(delimiter []byte, maxFrameLength int, stripDelimiter bool) *DelimiterBasedFrameCodec {
+	if len(delimiter) == 0 {
+		panic("icodecs: delimiter must not be empty")
+	}
+	return &DelimiterBasedFrameCodec{delimiter: delimiter, maxFrameLength: maxFrameLength, stripDelimiter: stripDelimiter}
+}
+
+func (cc *DelimiterBasedFrameCodec) Encode(buf []byte) ([]byte, error) {
+	out := make([]byte, 0, len(buf)+len(cc.delimiter))
+	return append(append(out, buf...), cc.delimiter...), nil
+}
+
+func (cc *DelimiterBasedFrameCodec) Decode(buf []byte) ([]byte, int, error) {
+	idx := bytes.Index(buf, cc.delimiter)
+	if idx < 0 {
+		// 还没有找到分隔符，但是缓冲区中的数据已经超过了报文的最大长度，缓冲区末尾可能是只到达了一部分的分隔符
+		if cc.maxFrameLength > 0 && len(buf) > cc.maxFrameLength+len(cc.delimiter)-1 {
+			return nil, 0, errors.ErrTooLongFrame
+		}
+		return nil, 0, errors.ErrIncompletePacket
+	}
+	if cc.maxFrameLength > 0 && idx > cc.maxFrameLength {
+		return nil, 0, errors.ErrTooLongFrame
+	}
+
+	consumed := idx + len(cc.delimiter)
+	if cc.stripDelimiter {
+		return buf[:idx], consumed, nil
+	}
+	return buf[:consumed], consumed, nil
+}
+
+// maxFrameLength是不包含换行符的行最大长度，为0时不做限制；stripDelimiter表示解码出来的行是否去掉换行符
+func NewLineBasedFrameCodec(maxFrameLength int, stripDelimiter bool) *LineBasedFrameCodec {
+	return &LineBasedFrameCodec{maxFrameLength: maxFrameLength, stripDelimiter: stripDelimiter}
+}
+
+func (cc *LineBasedFrameCodec) Encode(buf []byte) ([]byte, error) {
+	out := make([]byte, 0, len(buf)+len(crlf))
+	return append(append(out, buf...), crlf...), nil
+}
+
+func (cc *LineBasedFrameCodec) Decode(buf []byte) ([]byte, int, error) {
+	idx := bytes.IndexByte(buf, '\n')
+	if idx < 0 {
+		// 还没有找到换行符，但是缓冲区中的数据已经超过了行的最大长度，多出的一个字节可能是'\r'
+		if cc.maxFrameLength > 0 && len(buf) > cc.maxFrameLength+1 {
+			return nil, 0, errors.ErrTooLongFrame
+		}
+		return nil, 0, errors.ErrIncompletePacket
+	}
+
+	end := idx
+	if end > 0 && buf[end-1] == '\r' {
+		end--
+	}
+	if cc.maxFrameLength > 0 && end > cc.maxFrameLength {
+		return nil, 0, errors.ErrTooLongFrame
+	}
+
+	if cc.stripDelimiter {
+		return buf[:end], idx + 1, nil
+	}
+	return buf[:idx+1], idx + 1, nil
+}
@@ -0,0 +1,31 @@
+package icodecs
+
+import "greactor/src/errors"
+
+// 定长编解码器，把数据流切分成固定长度的报文
+type FixedLengthFrameCodec struct {
+	frameLength int
+}
+
+// frameLength必须大于0，否则panic
+func NewFixedLengthFrameCodec(frameLength int) *FixedLengthFrameCodec {
+	if frameLength <= 0 {
+		panic("icodecs: frame length must be positive")
+	}
+	return &FixedLengthFrameCodec{frameLength: frameLength}
+}
+
+// 发送的数据长度必须是报文长度的整数倍，否则返回errors.ErrInvalidFixedLength
+func (cc *FixedLengthFrameCodec) Encode(buf []byte) ([]byte, error) {
+	if len(buf)%cc.frameLength != 0 {
+		return nil, errors.ErrInvalidFixedLength
+	}
+	return buf, nil
+}
+
+func (cc *FixedLengthFrameCodec) Decode(buf []byte) ([]byte, int, error) {
+	if len(buf) < cc.frameLength {
+		return nil, 0, errors.ErrIncompletePacket
+	}
+	return buf[:cc.frameLength], cc.frameLength, nil
+}
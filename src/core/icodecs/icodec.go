@@ -5,8 +5,9 @@ type (
 	ICodec interface {
 		// 对报文进行编码
 		Encode(buf []byte) ([]byte, error)
-		// 对报文进行解码
-		Decode(buf []byte) ([]byte, error)
+		// 从buf的开头解码出一个完整的报文，consumed是解码时从buf中消费的字节数，
+		// buf中的数据不足以组成一个完整的报文时返回errors.ErrIncompletePacket，等待更多的数据到达
+		Decode(buf []byte) (frame []byte, consumed int, err error)
 	}
 
 	// 默认内置的编码解码器
@@ -17,6 +18,6 @@ func (cc *BuiltInFrameCodec) Encode(buf []byte) ([]byte, error) {
 	return buf, nil
 }
 
-func (cc *BuiltInFrameCodec) Decode(buf []byte) ([]byte, error) {
-	return buf, nil
+func (cc *BuiltInFrameCodec) Decode(buf []byte) ([]byte, int, error) {
+	return buf, len(buf), nil
 }
@@ -0,0 +1,164 @@
+package icodecs
+
+import (
+	"encoding/binary"
+	"greactor/src/errors"
+)
+
+type (
+	// 基于长度字段的编解码器，报文的开头带有一个表示报文长度的字段
+	LengthFieldBasedFrameCodec struct {
+		encoderConfig EncoderConfig
+		decoderConfig DecoderConfig
+	}
+
+	// 编码配置
+	EncoderConfig struct {
+		// 长度字段的字节序，默认为大端
+		ByteOrder binary.ByteOrder
+		// 长度字段占用的字节数，只支持1、2、3、4、8
+		LengthFieldLength int
+		// 写入长度字段之前对长度进行的调整
+		LengthAdjustment int
+		// 长度字段的值是否包含长度字段本身占用的字节数
+		LengthIncludesLengthFieldLength bool
+	}
+
+	// 解码配置
+	DecoderConfig struct {
+		// 长度字段的字节序，默认为大端
+		ByteOrder binary.ByteOrder
+		// 长度字段在报文中的偏移量
+		LengthFieldOffset int
+		// 长度字段占用的字节数，只支持1、2、3、4、8
+		LengthFieldLength int
+		// 长度字段的值加上这个调整值，才是长度字段之后的报文长度
+		LengthAdjustment int
+		// 解码出来的报文需要从开头跳过的字节数，比如跳过报文头
+		InitialBytesToStrip int
+		// 报文的最大长度，超过之后返回errors.ErrTooLongFrame，为0时不做限制
+		MaxFrameLength int
+	}
+)
+
+func NewLengthFieldBasedFrameCodec(ec EncoderConfig, dc DecoderConfig) *LengthFieldBasedFrameCodec {
+	if ec.ByteOrder == nil {
+		ec.ByteOrder = binary.BigEndian
+	}
+	if dc.ByteOrder == nil {
+		dc.ByteOrder = binary.BigEndian
+	}
+	return &LengthFieldBasedFrameCodec{encoderConfig: ec, decoderConfig: dc}
+}
+
+func (cc *LengthFieldBasedFrameCodec) Encode(buf []byte) ([]byte, error) {
+	ec := &cc.encoderConfig
+	length := len(buf) + ec.LengthAdjustment
+	if ec.LengthIncludesLengthFieldLength {
+		length += ec.LengthFieldLength
+	}
+	if length < 0 {
+		return nil, errors.ErrTooLessLength
+	}
+
+	out := make([]byte, ec.LengthFieldLength, ec.LengthFieldLength+len(buf))
+	if err := putLength(ec.ByteOrder, out, uint64(length)); err != nil {
+		return nil, err
+	}
+	return append(out, buf...), nil
+}
+
+func (cc *LengthFieldBasedFrameCodec) Decode(buf []byte) ([]byte, int, error) {
+	dc := &cc.decoderConfig
+	lengthFieldEndOffset := dc.LengthFieldOffset + dc.LengthFieldLength
+	if len(buf) < lengthFieldEndOffset {
+		return nil, 0, errors.ErrIncompletePacket
+	}
+
+	length, err := getLength(dc.ByteOrder, buf[dc.LengthFieldOffset:lengthFieldEndOffset])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	frameLength := int64(length) + int64(dc.LengthAdjustment) + int64(lengthFieldEndOffset)
+	if frameLength < int64(lengthFieldEndOffset) || frameLength < int64(dc.InitialBytesToStrip) {
+		return nil, 0, errors.ErrTooLessLength
+	}
+	if dc.MaxFrameLength > 0 && frameLength > int64(dc.MaxFrameLength) {
+		return nil, 0, errors.ErrTooLongFrame
+	}
+	if int64(len(buf)) < frameLength {
+		return nil, 0, errors.ErrIncompletePacket
+	}
+
+	return buf[dc.InitialBytesToStrip:frameLength], int(frameLength), nil
+}
+
+// 按照字节序把长度写入长度字段中
+func putLength(order binary.ByteOrder, field []byte, length uint64) error {
+	switch len(field) {
+	case 1:
+		if length > 0xff {
+			return errors.ErrLengthFieldOverflow
+		}
+		field[0] = byte(length)
+	case 2:
+		if length > 0xffff {
+			return errors.ErrLengthFieldOverflow
+		}
+		order.PutUint16(field, uint16(length))
+	case 3:
+		if length > 0xffffff {
+			return errors.ErrLengthFieldOverflow
+		}
+		var b [4]byte
+		order.PutUint32(b[:], uint32(length))
+		if lowBytesFirst(order) {
+			copy(field, b[:3])
+		} else {
+			copy(field, b[1:])
+		}
+	case 4:
+		if length > 0xffffffff {
+			return errors.ErrLengthFieldOverflow
+		}
+		order.PutUint32(field, uint32(length))
+	case 8:
+		order.PutUint64(field, length)
+	default:
+		return errors.ErrUnsupportedLength
+	}
+	return nil
+}
+
+// 按照字节序从长度字段中读取长度
+func getLength(order binary.ByteOrder, field []byte) (uint64, error) {
+	switch len(field) {
+	case 1:
+		return uint64(field[0]), nil
+	case 2:
+		return uint64(order.Uint16(field)), nil
+	case 3:
+		var b [4]byte
+		if lowBytesFirst(order) {
+			copy(b[:3], field)
+		} else {
+			copy(b[1:], field)
+		}
+		return uint64(order.Uint32(b[:])), nil
+	case 4:
+		return uint64(order.Uint32(field)), nil
+	case 8:
+		return order.Uint64(field), nil
+	default:
+		return 0, errors.ErrUnsupportedLength
+	}
+}
+
+// 3字节的长度字段借助4字节的缓冲区用order编解码，取其中低3字节所在的位置。
+// 不能直接和binary.LittleEndian比较，调用方可能传入包装过的字节序
+func lowBytesFirst(order binary.ByteOrder) bool {
+	var b [4]byte
+	order.PutUint32(b[:], 1)
+	return b[0] == 1
+}
@@ -6,8 +6,10 @@ import (
 	"greactor/src/core/netpoll"
 	"greactor/src/errors"
 	"greactor/src/socket"
+	"net"
 	"os"
 	"sync"
+	"time"
 )
 
 type listener struct {
@@ -15,6 +17,11 @@ type listener struct {
 	fd             int
 	saddr          *socket.ServerAddr
 	sockOpts       []socket.Option
+	connSockOpts   []socket.Option // 需要设置到每一个新连接上的socket选项
+	unixPerm       os.FileMode     // unix socket文件的权限
+	backlog        int
+	reusePort      bool
+	quickAck       bool                    // 每次读取数据之后重新开启连接上的TCP_QUICKACK
 	pollAttachment *netpoll.PollAttachment // listener attachment for poller
 }
 
@@ -26,28 +33,169 @@ func (ln *listener) packPollAttachment(handler netpoll.PollEventHandler) *netpol
 func (ln *listener) prepare() (err error) {
 	switch ln.saddr.Network {
 	case "tcp", "tcp4", "tcp6":
-		ln.fd, err = socket.TCPSocket(ln.saddr, true, ln.sockOpts...)
+		ln.fd, err = socket.TCPSocket(ln.saddr, true, ln.backlog, ln.sockOpts...)
+	case "udp", "udp4", "udp6":
+		ln.fd, err = socket.UDPSocket(ln.saddr, false, ln.sockOpts...)
+	case "unix":
+		ln.fd, err = socket.UnixSocket(ln.saddr, true, ln.unixPerm, ln.backlog, ln.sockOpts...)
 	default:
 		err = errors.ErrUnsupportedProtocol
 	}
 	return
 }
 
+// 是否是UDP监听器
+func (ln *listener) isUDP() bool {
+	switch ln.saddr.Network {
+	case "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+// 是否可以通过SO_REUSEPORT让多个监听器绑定同一个地址，unix socket不支持
+func (ln *listener) isReusePort() bool {
+	return ln.reusePort && ln.saddr.Network != "unix"
+}
+
 func initListener(addr *socket.ServerAddr, options *Options) (l *listener, err error) {
-	var sockOpts []socket.Option
-	l = &listener{saddr: addr, sockOpts: sockOpts}
-	err = l.prepare()
+	var sockOpts, connSockOpts []socket.Option
+	isTCP, isUDP := false, false
+	switch addr.Network {
+	case "tcp", "tcp4", "tcp6":
+		isTCP = true
+	case "udp", "udp4", "udp6":
+		isUDP = true
+	}
+
+	// 和标准库一样，TCP监听socket总是开启SO_REUSEADDR，避免服务器重启时端口被TIME_WAIT状态的连接占用导致绑定失败
+	if isTCP || (isUDP && options.ReuseAddr) {
+		sockOpts = append(sockOpts, socket.Option{SetSockOpt: socket.SetReuseAddr, Opt: 1})
+	}
+	if options.ReusePort && addr.Network != "unix" {
+		sockOpts = append(sockOpts, socket.Option{SetSockOpt: socket.SetReusePort, Opt: 1})
+	}
+	if options.SocketRecvBuffer > 0 {
+		sockOpt := socket.Option{SetSockOpt: socket.SetRecvBuffer, Opt: options.SocketRecvBuffer}
+		sockOpts, connSockOpts = append(sockOpts, sockOpt), append(connSockOpts, sockOpt)
+	}
+	if options.SocketSendBuffer > 0 {
+		sockOpt := socket.Option{SetSockOpt: socket.SetSendBuffer, Opt: options.SocketSendBuffer}
+		sockOpts, connSockOpts = append(sockOpts, sockOpt), append(connSockOpts, sockOpt)
+	}
+	if isTCP {
+		if options.TCPNoDelay == TCPNoDelay {
+			connSockOpts = append(connSockOpts, socket.Option{SetSockOpt: socket.SetNoDelay, Opt: 1})
+		}
+		if options.TCPKeepAlive > 0 {
+			connSockOpts = append(connSockOpts, socket.Option{SetSockOpt: socket.SetKeepAlivePeriod, Opt: durationToSeconds(options.TCPKeepAlive)})
+		}
+		if options.TCPFastOpen > 0 {
+			sockOpts = append(sockOpts, socket.Option{SetSockOpt: socket.SetFastOpen, Opt: options.TCPFastOpen})
+		}
+		if options.TCPDeferAccept > 0 {
+			sockOpts = append(sockOpts, socket.Option{SetSockOpt: socket.SetDeferAccept, Opt: durationToSeconds(options.TCPDeferAccept)})
+		}
+		if options.TCPUserTimeout > 0 {
+			connSockOpts = append(connSockOpts, socket.Option{SetSockOpt: socket.SetUserTimeout, Opt: int(options.TCPUserTimeout / time.Millisecond)})
+		}
+		if options.TCPQuickAck {
+			connSockOpts = append(connSockOpts, socket.Option{SetSockOpt: socket.SetQuickAck, Opt: 1})
+		}
+	}
+	if options.TOS != 0 && addr.Network != "unix" {
+		// 新连接会继承监听socket的TOS。双栈的IPv6 socket上的IPv4连接使用IP_TOS，两个都要设置
+		if addr.Family == unix.AF_INET6 {
+			sockOpts = append(sockOpts, socket.Option{SetSockOpt: socket.SetTrafficClass, Opt: options.TOS})
+		}
+		if addr.Family == unix.AF_INET || !addr.V6Only {
+			sockOpts = append(sockOpts, socket.Option{SetSockOpt: socket.SetTOS, Opt: options.TOS})
+		}
+	}
+	if options.BindToDevice != "" && addr.Network != "unix" {
+		ifname := options.BindToDevice
+		sockOpts = append(sockOpts, socket.Option{SetSockOpt: func(fd, _ int) error {
+			return socket.SetBindToDevice(fd, ifname)
+		}})
+	}
+	// SO_LINGER大于0时close会阻塞event-loop，只允许关闭连接时直接发送RST
+	if options.Linger > 0 {
+		return nil, errors.ErrPositiveLinger
+	}
+	if !isUDP && options.Linger < 0 {
+		connSockOpts = append(connSockOpts, socket.Option{SetSockOpt: socket.SetLinger, Opt: 0})
+	}
+
+	l = &listener{saddr: addr, sockOpts: sockOpts, connSockOpts: connSockOpts, unixPerm: options.UnixSocketPerm, backlog: options.Backlog, reusePort: options.ReusePort}
+	l.quickAck = isTCP && options.TCPQuickAck
+	if err = l.prepare(); err != nil {
+		return
+	}
+	if err = l.resolveBoundAddr(); err != nil {
+		l.close()
+	}
 	return
 }
 
+// 监听的端口为0时由内核分配端口，把监听器的地址更新为实际绑定的地址，
+// 这样SO_REUSEPORT模式下其它event-loop的监听器才能绑定到同一个端口上
+func (ln *listener) resolveBoundAddr() error {
+	switch addr := ln.saddr.NetAddr.(type) {
+	case *net.TCPAddr:
+		if addr.Port != 0 {
+			return nil
+		}
+	case *net.UDPAddr:
+		if addr.Port != 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	sa, err := unix.Getsockname(ln.fd)
+	if err != nil {
+		return os.NewSyscallError("getsockname", err)
+	}
+	saddr := *ln.saddr
+	saddr.Sa = sa
+	if ln.isUDP() {
+		saddr.NetAddr = socket.SockaddrToUDPAddr(sa)
+	} else {
+		saddr.NetAddr = socket.SockaddrToTCPOrUnixAddr(sa)
+	}
+	saddr.Address = saddr.NetAddr.String()
+	ln.saddr = &saddr
+	return nil
+}
+
+// 把监听器上配置的socket选项设置到新连接上
+func (ln *listener) setConnSockOpts(fd int) error {
+	for _, sockOpt := range ln.connSockOpts {
+		if err := sockOpt.SetSockOpt(fd, sockOpt.Opt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把时长转换为秒数，不足一秒的部分向上取整
+func durationToSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
 func (ln *listener) close() {
 	ln.once.Do(
 		func() {
 			if ln.fd > 0 {
-				fmt.Println(os.NewSyscallError("close", unix.Close(ln.fd)).Error())
+				if err := os.NewSyscallError("close", unix.Close(ln.fd)); err != nil {
+					fmt.Printf("failed to close listener: %v\n", err)
+				}
 			}
-			if ln.saddr.Network == "unix" {
-				fmt.Println(os.RemoveAll(ln.saddr.Address).Error())
+			if ln.saddr.Network == "unix" && !socket.IsAbstractUnixAddr(ln.saddr.Address) {
+				if err := os.RemoveAll(ln.saddr.Address); err != nil {
+					fmt.Printf("failed to remove unix socket file: %v\n", err)
+				}
 			}
 		})
 }
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"golang.org/x/sys/unix"
+	"greactor/src/socket"
+	"net"
+	"testing"
+)
+
+// 留在core包内：根据地址族选择IP_TOS还是IPV6_TCLASS是在initListener中决定的，
+// 需要读取监听socket的fd检查设置的结果，服务器和连接都没有对外暴露fd
+func TestListenerTOS(test *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		test.Skip("IPv6 is not available")
+	} else {
+		_ = ln.Close()
+	}
+
+	cases := []struct {
+		network     string
+		tos, tclass int
+	}{
+		// 双栈socket上的IPv4连接使用IP_TOS，IPv6连接使用IPV6_TCLASS
+		{"tcp", 0x20, 0x20},
+		{"tcp6", 0, 0x20},
+	}
+	for _, tc := range cases {
+		addr, err := socket.ResolveServerAddr(tc.network, "[::1]:0")
+		if err != nil {
+			test.Fatal(err)
+		}
+		l, err := initListener(addr, &Options{TOS: 0x20})
+		if err != nil {
+			test.Fatal(err)
+		}
+		tos, err := unix.GetsockoptInt(l.fd, unix.IPPROTO_IP, unix.IP_TOS)
+		if err != nil {
+			test.Fatal(err)
+		}
+		tclass, err := unix.GetsockoptInt(l.fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+		if err != nil {
+			test.Fatal(err)
+		}
+		l.close()
+		if tos != tc.tos || tclass != tc.tclass {
+			test.Fatalf("%s: expected IP_TOS %#x and IPV6_TCLASS %#x, got %#x and %#x", tc.network, tc.tos, tc.tclass, tos, tclass)
+		}
+	}
+}
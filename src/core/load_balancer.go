@@ -1,7 +1,9 @@
 package core
 
 import (
+	"hash/crc32"
 	"net"
+	"strconv"
 )
 
 // 当一个新连接建立时，分配给事件循环组中的某个event-loop处理，所使用的负载均衡算法
@@ -10,9 +12,32 @@ type LoadBalancing int
 const (
 	RoundRobin LoadBalancing = iota
 
+	// 把新连接分配给当前活跃连接数最少的event-loop
+	LeastConnections
+
+	// 根据客户端的IP做哈希，同一个客户端的连接总是分配给同一个event-loop
+	SourceAddrHash
+
+	// 根据客户端的IP和端口做哈希
+	SourceAddrPortHash
 )
 
 type (
+	// LoopInfo 是event-loop的只读视图，提供给自定义的负载均衡器使用
+	LoopInfo interface {
+		// 在事件循环线程组中的索引
+		Index() int
+		// 当前活跃的连接数，包括已经分配给它但还没有注册完成的连接
+		ConnCount() int
+	}
+
+	// LoadBalancer 自定义的负载均衡器，通过Options.CustomLB设置。
+	// Next在接收新连接的线程中被调用，返回值为新连接要分配到的event-loop在loops中的下标，
+	// 超出范围时会对len(loops)取模
+	LoadBalancer interface {
+		Next(remoteAddr net.Addr, loops []LoopInfo) int
+	}
+
 	// eventLoop负载均衡算法
 	loadBalancer interface {
 		register(*eventLoop)
@@ -27,6 +52,27 @@ type (
 		eventLoops    []*eventLoop
 		size          int
 	}
+
+	// leastConnectionsLoadBalancer with Least-Connections algorithm.
+	leastConnectionsLoadBalancer struct {
+		eventLoops []*eventLoop
+		size       int
+	}
+
+	// sourceAddrHashLoadBalancer with Hash algorithm.
+	sourceAddrHashLoadBalancer struct {
+		eventLoops []*eventLoop
+		size       int
+		withPort   bool // 是否把端口也加入哈希
+	}
+
+	// customLoadBalancer 把用户自定义的LoadBalancer适配为loadBalancer
+	customLoadBalancer struct {
+		lb         LoadBalancer
+		eventLoops []*eventLoop
+		loops      []LoopInfo
+		size       int
+	}
 )
 
 func (lb *roundRobinLoadBalancer) register(el *eventLoop) {
@@ -55,3 +101,112 @@ func (lb *roundRobinLoadBalancer) iterate(f func(int, *eventLoop) bool) {
 func (lb *roundRobinLoadBalancer) len() int {
 	return lb.size
 }
+
+func (lb *leastConnectionsLoadBalancer) register(el *eventLoop) {
+	el.idx = lb.size
+	lb.eventLoops = append(lb.eventLoops, el)
+	lb.size++
+}
+
+// next returns the eligible events-loop with the fewest active connections,
+// ties are broken in favor of the loop with the lower index.
+func (lb *leastConnectionsLoadBalancer) next(_ net.Addr) (el *eventLoop) {
+	el = lb.eventLoops[0]
+	minN := el.ConnCount()
+	for _, v := range lb.eventLoops[1:] {
+		if n := v.ConnCount(); n < minN {
+			minN = n
+			el = v
+		}
+	}
+	return
+}
+
+func (lb *leastConnectionsLoadBalancer) iterate(f func(int, *eventLoop) bool) {
+	for i, el := range lb.eventLoops {
+		if !f(i, el) {
+			break
+		}
+	}
+}
+
+func (lb *leastConnectionsLoadBalancer) len() int {
+	return lb.size
+}
+
+func (lb *sourceAddrHashLoadBalancer) register(el *eventLoop) {
+	el.idx = lb.size
+	lb.eventLoops = append(lb.eventLoops, el)
+	lb.size++
+}
+
+// next returns the eligible events-loop by taking the remainder of a hash code as the index of events-loop.
+// 使用crc32而不是带随机种子的哈希，这样在event-loop数量不变时，重启之后同一个客户端仍然分配给同一个event-loop
+func (lb *sourceAddrHashLoadBalancer) next(remoteAddr net.Addr) *eventLoop {
+	return lb.eventLoops[int(lb.hash(remoteAddr)%uint32(lb.size))]
+}
+
+func (lb *sourceAddrHashLoadBalancer) hash(remoteAddr net.Addr) uint32 {
+	var (
+		ip   net.IP
+		port int
+	)
+	switch addr := remoteAddr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	case nil:
+		return 0
+	default:
+		return crc32.ChecksumIEEE([]byte(remoteAddr.String()))
+	}
+	// IPv4和IPv4-mapped IPv6地址得到相同的哈希值
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if !lb.withPort {
+		return crc32.ChecksumIEEE(ip)
+	}
+	return crc32.ChecksumIEEE(strconv.AppendInt(append(ip[:len(ip):len(ip)], ':'), int64(port), 10))
+}
+
+func (lb *sourceAddrHashLoadBalancer) iterate(f func(int, *eventLoop) bool) {
+	for i, el := range lb.eventLoops {
+		if !f(i, el) {
+			break
+		}
+	}
+}
+
+func (lb *sourceAddrHashLoadBalancer) len() int {
+	return lb.size
+}
+
+func (lb *customLoadBalancer) register(el *eventLoop) {
+	el.idx = lb.size
+	lb.eventLoops = append(lb.eventLoops, el)
+	lb.loops = append(lb.loops, el)
+	lb.size++
+}
+
+// next returns the events-loop chosen by the user-defined LoadBalancer.
+func (lb *customLoadBalancer) next(remoteAddr net.Addr) *eventLoop {
+	idx := lb.lb.Next(remoteAddr, lb.loops) % lb.size
+	if idx < 0 {
+		idx += lb.size
+	}
+	return lb.eventLoops[idx]
+}
+
+func (lb *customLoadBalancer) iterate(f func(int, *eventLoop) bool) {
+	for i, el := range lb.eventLoops {
+		if !f(i, el) {
+			break
+		}
+	}
+}
+
+func (lb *customLoadBalancer) len() int {
+	return lb.size
+}
@@ -5,10 +5,12 @@ import (
 	"golang.org/x/sys/unix"
 	"greactor/src/core/queue"
 	"greactor/src/errors"
+	"math"
 	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -32,6 +34,9 @@ var (
 // 当epoll上监听的fd有I/O事件触发时，会调用这个回调函数
 type PollEventHandler func(int, uint32) error
 
+// 轮询器的定时回调，返回距离下一次需要被调用的时长，小于0时表示没有待处理的定时任务
+type TimerHandler func() (time.Duration, error)
+
 type PollAttachment struct {
 	FD       int
 	Callback PollEventHandler
@@ -43,6 +48,7 @@ type Poller struct {
 	wfdBuf         []byte // 事件队列缓冲区
 	netpollWakeSig int32
 	asyncTaskQueue queue.AsyncTaskQueue // 异步事件队列
+	timerHandler   TimerHandler         // 每次epoll_wait之前调用，用它的返回值作为epoll_wait的超时时间
 }
 
 func OpenPoller() (poller *Poller, err error) {
@@ -112,7 +118,23 @@ func (p *Poller) Polling(callback func(fd int, ev uint32) error) error {
 
 	msec := -1
 	for {
-		n, err := unix.EpollWait(p.fd, el.events, msec)
+		timeout := msec
+		if p.timerHandler != nil {
+			delay, err := p.timerHandler()
+			switch err {
+			case nil:
+			case errors.ErrServerShutdown:
+				return err
+			default:
+				fmt.Printf("error occurs in timer: %v", err)
+			}
+			// 上一轮有事件时不阻塞，否则最多等到下一个定时任务到期
+			if delay >= 0 && msec != 0 {
+				timeout = durationToMsec(delay)
+			}
+		}
+
+		n, err := unix.EpollWait(p.fd, el.events, timeout)
 		if n == 0 || (n < 0 && err == unix.EINTR) {
 			msec = -1
 			runtime.Gosched()
@@ -174,6 +196,23 @@ func (p *Poller) Polling(callback func(fd int, ev uint32) error) error {
 	}
 }
 
+// 设置定时回调，必须在Polling之前调用
+func (p *Poller) SetTimerHandler(handler TimerHandler) {
+	p.timerHandler = handler
+}
+
+// 把时长转换为epoll_wait的超时毫秒数，不足一毫秒的部分向上取整，避免定时任务还没到期就提前醒来空转
+func durationToMsec(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	msec := (d + time.Millisecond - 1) / time.Millisecond
+	if msec > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(msec)
+}
+
 func (p *Poller) AddRead(pa *PollAttachment) error {
 	return os.NewSyscallError("epoll_ctl add",
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, pa.FD, &unix.EpollEvent{Fd: int32(pa.FD), Events: readEvents}))
@@ -189,6 +228,11 @@ func (p *Poller) ModReadWrite(pa *PollAttachment) error {
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, pa.FD, &unix.EpollEvent{Fd: int32(pa.FD), Events: readWriteEvents}))
 }
 
+func (p *Poller) ModWrite(pa *PollAttachment) error {
+	return os.NewSyscallError("epoll_ctl mod",
+		unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, pa.FD, &unix.EpollEvent{Fd: int32(pa.FD), Events: writeEvents}))
+}
+
 func (p *Poller) ModRead(pa *PollAttachment) error {
 	return os.NewSyscallError("epoll_ctl mod",
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, pa.FD, &unix.EpollEvent{Fd: int32(pa.FD), Events: readEvents}))
@@ -221,6 +265,14 @@ func PutPollAttachment(pa *PollAttachment) {
 	pollAttachmentPool.Put(pa)
 }
 
+// 丢弃任务队列中还没有执行的任务，在事件循环退出之后调用，由fn释放任务参数持有的资源
+func (p *Poller) DiscardTasks(fn func(arg interface{})) {
+	for task := p.asyncTaskQueue.Dequeue(); task != nil; task = p.asyncTaskQueue.Dequeue() {
+		fn(task.Arg)
+		queue.PutTask(task)
+	}
+}
+
 func (p *Poller) Trigger(fn queue.TaskFunc, arg interface{}) (err error) {
 	task := queue.GetTask()
 	task.Run, task.Arg = fn, arg
@@ -2,16 +2,105 @@ package core
 
 import (
 	"greactor/src/core/icodecs"
+	"os"
 	"time"
 )
 
+// TCP socket选项
+type TCPSocketOpt int
+
+const (
+	// 开启TCP_NODELAY
+	TCPNoDelay TCPSocketOpt = iota
+	// 不开启TCP_NODELAY，使用Nagle算法合并小数据包
+	TCPDelay
+)
+
 type Options struct {
 
 	Multicore bool
 
+	// event-loop的数量，大于0时忽略Multicore
+	NumEventLoop int
+
+	// 每个event-loop独占一个系统线程，这种模式下event-loop的数量加上主reactor不能超过10000
+	LockOSThread bool
+
+	// 把每个event-loop的线程绑定到一个CPU上，按顺序轮流使用当前进程允许使用的CPU，会自动开启LockOSThread
+	CPUAffinity bool
+
 	LB LoadBalancing
+
+	// 自定义的负载均衡器，不为nil时忽略LB，ReusePort模式下不生效
+	CustomLB LoadBalancer
 	// 编码解码器
 	Codec icodecs.ICodec
+	// 原始读取模式，不使用Codec解码。每次读到数据都回调一次React，packet是入站缓冲区中所有还没有被消费的数据，
+	// React通过Peek、Next、Discard自己决定消费多少，没有消费的数据留到下一次读到数据时再处理。
+	// 一次读取可能包含多个完整的报文，React需要自己处理完缓冲区中所有完整的报文。Codec仍然用于编码写出的数据
+	RawRead bool
 
+	// 是否开启TCP_NODELAY，默认开启，也就是关闭Nagle算法，小数据包会被立即发送
+	TCPNoDelay TCPSocketOpt
+
+	// TCP连接的保活探测周期，为0时不开启SO_KEEPALIVE
 	TCPKeepAlive time.Duration
+
+	// socket接收缓冲区的大小(SO_RCVBUF)，为0时使用系统默认值
+	SocketRecvBuffer int
+
+	// socket发送缓冲区的大小(SO_SNDBUF)，为0时使用系统默认值
+	SocketSendBuffer int
+
+	// UDP监听socket是否开启SO_REUSEADDR，TCP监听socket和标准库一样总是开启
+	ReuseAddr bool
+
+	// 连接的SO_LINGER，为0时使用系统默认值；小于0时关闭连接会丢弃未发送的数据并直接发送RST。
+	// 不支持大于0的值：关闭socket时会阻塞等待数据发送完毕，阻塞期间整个event-loop都无法处理其它连接，
+	// 此时Run返回ErrPositiveLinger
+	Linger time.Duration
+
+	// 开启SO_REUSEPORT模式，不再使用主reactor接收新连接，每个event-loop都绑定自己的监听socket并直接接收新连接，
+	// 由内核在它们之间做负载均衡，适合大量短连接的场景
+	ReusePort bool
+
+	// 监听socket的TCP_FASTOPEN队列长度，为0时不开启
+	TCPFastOpen int
+
+	// 监听socket的TCP_DEFER_ACCEPT，连接上有数据到达之后才接收新连接，最多等待这么久，为0时不开启
+	TCPDeferAccept time.Duration
+
+	// 连接的TCP_USER_TIMEOUT，已发送的数据超过这么久仍未被确认时关闭连接，为0时使用系统默认值
+	TCPUserTimeout time.Duration
+
+	// 是否在连接上开启TCP_QUICKACK，尽快发送ACK。TCP_QUICKACK不是持久的，内核之后可能重新进入延迟确认模式，
+	// 所以每次读取数据之后都会重新设置一次，代价是每次读取多一次系统调用
+	TCPQuickAck bool
+
+	// IP_TOS(IPv6为IPV6_TCLASS)，用于DSCP标记，为0时使用系统默认值
+	TOS int
+
+	// SO_BINDTODEVICE，只在这个网卡上收发数据，为空时不绑定
+	BindToDevice string
+
+	// listen的backlog参数，为0时使用默认值
+	Backlog int
+
+	// unix socket文件的权限，为0时使用创建文件时的默认权限，对抽象命名空间中的地址无效
+	UnixSocketPerm os.FileMode
+
+	// 是否开启定时回调EventHandler.OnTick
+	Ticker bool
+
+	// 连接上既没有读到数据也没有写出数据超过这个时长时关闭连接，OnClosed收到的错误为ErrIdleTimeout，为0时不检测
+	IdleTimeout time.Duration
+
+	// 连接上没有读到数据超过这个时长时关闭连接，为0时不检测
+	ReadIdleTimeout time.Duration
+
+	// 连接上没有写出数据超过这个时长时关闭连接，为0时不检测
+	WriteIdleTimeout time.Duration
+
+	// 关闭服务器时等待连接中积压的数据发送完毕的最长时间，超时后强制关闭连接，为0时不等待
+	ShutdownTimeout time.Duration
 }
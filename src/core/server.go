@@ -1,14 +1,13 @@
 package core
 
 import (
+	"context"
 	"fmt"
-	"golang.org/x/sys/unix"
 	"greactor/src/core/icodecs"
 	"greactor/src/core/netpoll"
 	"greactor/src/errors"
 	"greactor/src/socket"
 	"net"
-	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -16,7 +15,7 @@ import (
 )
 
 type Server struct {
-	ln           *listener
+	lns          []*listener // 服务器监听的所有地址
 	lb           loadBalancer
 	wg           sync.WaitGroup
 	opts         *Options
@@ -24,21 +23,30 @@ type Server struct {
 	cond         *sync.Cond
 	mainLoop     *eventLoop
 	inShutdown   int32
+	stopping     int32
+	started      int32         // Run或者Stop是否已经被调用过
+	lockOSThread bool          // 每个event-loop是否独占一个系统线程
+	done         chan struct{} // 服务器完全关闭后被关闭
+	signaled     bool          // 是否已经发出关闭信号，防止信号先于waitForShutdown发出而丢失
 	eventHandler EventHandler
-	addr         *socket.ServerAddr
+	addrs        []*socket.ServerAddr
+	protoAddrs   []string
 }
 
 const (
 	// DefaultBufferSize is the first-time allocation on a ring-buffers.
 	DefaultBufferSize   = 1024     // 1KB
 	bufferGrowThreshold = 4 * 1024 // 4KB
+	// UDP数据报的最大长度，读取数据报的缓冲区必须能放下一个完整的数据报
+	maxUDPPacketSize = 64 * 1024 // 64KB
+	// LockOSThread模式下锁定线程的event-loop数量的上限，包括主reactor，和Go运行时默认的最大线程数一致
+	maxEventLoopThreads = 10000
 )
 
 var (
 	allServers sync.Map
-
-	// shutdownPollInterval is how often we poll to check whether server has been shut down during gnet.Stop().
-	shutdownPollInterval = 500 * time.Millisecond
+	// 保证删除时比较和删除是原子的，同一个地址可能先后登记了多个服务器
+	allServersMu sync.Mutex
 )
 
 type EventServer struct {
@@ -69,46 +77,93 @@ func (es *EventServer) React(packet []byte, c Conn) (out []byte, action Action)
 	return
 }
 
+func (es *EventServer) OnTick() (delay time.Duration, action Action) {
+	return
+}
+
 func NewServer(eventHandler EventHandler, protoAddr string, opts *Options) (s *Server, err error) {
-	var (
-		family  int
-		sa      unix.Sockaddr
-		netAddr net.Addr
-	)
-	network, address := socket.ParseProtoAddr(protoAddr)
-	if sa, family, netAddr, _, err = socket.GetTCPSockAddr(network, address); err != nil {
-		return nil, err
-	}
-	addr := &socket.ServerAddr{Sa: sa, NetAddr: netAddr, Address: address, Family: family, Network: network}
-	s = &Server{eventHandler: eventHandler, addr: addr, opts: opts}
+	return NewMultiAddrServer(eventHandler, []string{protoAddr}, opts)
+}
+
+// NewMultiAddrServer 创建一个同时监听多个地址的服务器，比如"tcp://0.0.0.0:9000"、"tcp6://[::]:9000"和"unix:///run/app.sock"，
+// 所有地址共用同一组event-loop
+func NewMultiAddrServer(eventHandler EventHandler, protoAddrs []string, opts *Options) (s *Server, err error) {
+	if len(protoAddrs) == 0 {
+		return nil, errors.ErrNoAddresses
+	}
+
+	addrs := make([]*socket.ServerAddr, 0, len(protoAddrs))
+	for _, protoAddr := range protoAddrs {
+		network, address := socket.ParseProtoAddr(protoAddr)
+		addr, err := socket.ResolveServerAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	s = &Server{eventHandler: eventHandler, addrs: addrs, opts: opts, protoAddrs: protoAddrs}
 	s.init()
 	return s, nil
 }
 
 func (s *Server) init() {
-	switch s.opts.LB {
-	case RoundRobin:
+	switch {
+	case s.opts.CustomLB != nil:
+		s.lb = &customLoadBalancer{lb: s.opts.CustomLB}
+	case s.opts.LB == RoundRobin:
 		s.lb = new(roundRobinLoadBalancer)
+	case s.opts.LB == LeastConnections:
+		s.lb = new(leastConnectionsLoadBalancer)
+	case s.opts.LB == SourceAddrHash:
+		s.lb = new(sourceAddrHashLoadBalancer)
+	case s.opts.LB == SourceAddrPortHash:
+		s.lb = &sourceAddrHashLoadBalancer{withPort: true}
 	default:
 		s.lb = new(roundRobinLoadBalancer)
 	}
 
+	// 绑定CPU时必须让event-loop独占线程，不修改使用者传入的Options
+	s.lockOSThread = s.opts.LockOSThread || s.opts.CPUAffinity
+
 	s.cond = sync.NewCond(&sync.Mutex{})
+	s.done = make(chan struct{})
 	if s.opts.Codec == nil {
 		s.opts.Codec = new(icodecs.BuiltInFrameCodec)
 	}
 }
 
 func (s *Server) Run() (err error) {
+	// Stop先于Run被调用，或者Run被重复调用
+	if !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		return errors.ErrServerInShutdown
+	}
+	// 无论是正常关闭还是启动失败，都要唤醒等待在Stop中的调用者
+	defer s.finish()
+
 	numEventLoop := 1
 	if s.opts.Multicore {
 		numEventLoop = runtime.NumCPU()
 	}
+	if s.opts.NumEventLoop > 0 {
+		numEventLoop = s.opts.NumEventLoop
+	}
+	// 不使用ReusePort时主reactor也锁定了一个线程
+	numThreads := numEventLoop
+	if !s.opts.ReusePort {
+		numThreads++
+	}
+	if s.lockOSThread && numThreads > maxEventLoopThreads {
+		return errors.ErrTooManyEventLoopThreads
+	}
 
-	if s.ln, err = initListener(s.addr, s.opts); err != nil {
-		return
+	defer s.closeListeners()
+	for _, addr := range s.addrs {
+		var ln *listener
+		if ln, err = initListener(addr, s.opts); err != nil {
+			return
+		}
+		s.lns = append(s.lns, ln)
 	}
-	defer s.ln.close()
 
 	switch s.eventHandler.OnInitComplete(s) {
 	case None:
@@ -116,44 +171,147 @@ func (s *Server) Run() (err error) {
 		return nil
 	}
 
-	if err = s.runReactors(numEventLoop); err != nil {
+	// 在启动事件循环之前登记服务器，保证能接收到连接时就能通过Stop关闭服务器
+	s.storeServer()
+	if s.opts.ReusePort {
+		err = s.activateEventLoops(numEventLoop)
+	} else {
+		err = s.runReactors(numEventLoop)
+	}
+	if err != nil {
+		s.deleteServer()
 		s.closeEventLoops()
 		fmt.Printf("gnet server is stopping with error: %v", err)
 		return err
 	}
 	defer s.stop()
 
-	allServers.Store(s.addr.Address, s)
 	return
 }
 
+// Addrs 返回服务器实际监听的地址，监听的端口为0时可以通过它得到内核分配的端口。
+// 监听器在Run中创建，需要在OnInitComplete中调用
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(s.addrs))
+	for i := 0; i < len(s.addrs) && i < len(s.lns); i++ {
+		addrs = append(addrs, s.lns[i].saddr.NetAddr)
+	}
+	return addrs
+}
+
+// Stop 优雅地关闭服务器：停止接收新连接，把各个event-loop中还没发送完的数据写出去，
+// 回调OnShutdown，并等待所有event-loop退出，直到ctx被取消为止。
+// 服务器已经关闭或者正在关闭时返回ErrServerInShutdown
+func (s *Server) Stop(ctx context.Context) error {
+	if s.isInShutdown() || !atomic.CompareAndSwapInt32(&s.stopping, 0, 1) {
+		return errors.ErrServerInShutdown
+	}
+	// Run还没有被调用，直接把服务器标记为已关闭
+	if atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		s.finish()
+		return nil
+	}
+	s.signalShutdown()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop 根据启动服务器时使用的协议地址找到对应的服务器并关闭它，没有服务器登记这个地址时返回ErrServerNotFound
+func Stop(ctx context.Context, protoAddr string) error {
+	if s, ok := allServers.Load(protoAddr); ok {
+		svr := s.(*Server)
+		defer svr.deleteServer()
+		return svr.Stop(ctx)
+	}
+	return errors.ErrServerNotFound
+}
+
+// 用服务器监听的每一个协议地址登记服务器，通过其中任意一个地址都能找到它
+func (s *Server) storeServer() {
+	allServersMu.Lock()
+	defer allServersMu.Unlock()
+	for _, protoAddr := range s.protoAddrs {
+		allServers.Store(protoAddr, s)
+	}
+}
+
+// 只删除自己登记的地址，地址已经被之后启动的服务器重新登记时保留它
+func (s *Server) deleteServer() {
+	allServersMu.Lock()
+	defer allServersMu.Unlock()
+	for _, protoAddr := range s.protoAddrs {
+		if v, ok := allServers.Load(protoAddr); ok && v == s {
+			allServers.Delete(protoAddr)
+		}
+	}
+}
+
+// 服务器已经完全关闭，唤醒等待在Stop中的调用者
+func (s *Server) finish() {
+	atomic.StoreInt32(&s.inShutdown, 1)
+	close(s.done)
+}
+
+func (s *Server) isInShutdown() bool {
+	return atomic.LoadInt32(&s.inShutdown) == 1
+}
+
 func (s *Server) runReactors(numEventLoop int) error {
-	for i := 0; i < numEventLoop; i++ {
-		if p, err := netpoll.OpenPoller(); err == nil {
-			el := new(eventLoop)
-			el.ln = s.ln
-			el.svr = s
-			el.poller = p
-			el.buffer = make([]byte, DefaultBufferSize)
-			el.connections = make(map[int]*conn)
-			el.eventHandler = s.eventHandler
-			s.lb.register(el)
+	var udpLns, streamLns []*listener
+	for _, ln := range s.lns {
+		if ln.isUDP() {
+			udpLns = append(udpLns, ln)
 		} else {
+			streamLns = append(streamLns, ln)
+		}
+	}
+
+	if err := s.openEventLoops(numEventLoop, len(udpLns) > 0); err != nil {
+		return err
+	}
+
+	// UDP没有连接，不需要主reactor接收新连接，由event-loop直接从监听的socket中读取数据报。
+	// 每个UDP监听器只注册到一个event-loop上，否则一个数据报会唤醒所有的event-loop，
+	// 需要多个event-loop同时处理同一个地址上的数据报时开启ReusePort，每个event-loop绑定自己的socket
+	for j, ln := range udpLns {
+		var err error
+		s.lb.iterate(func(i int, el *eventLoop) bool {
+			if i != j%s.lb.len() {
+				return true
+			}
+			el.listeners[ln.fd] = ln
+			err = el.poller.AddRead(&netpoll.PollAttachment{FD: ln.fd})
+			return false
+		})
+		if err != nil {
 			return err
 		}
 	}
 
 	s.runSubReactors()
+	if len(streamLns) == 0 {
+		return nil
+	}
 
+	// 所有面向连接的监听器都注册到主reactor中，由它接收新连接，再分配给各个event-loop
 	if p, err := netpoll.OpenPoller(); err == nil {
 		el := new(eventLoop)
-		el.ln = s.ln
 		el.idx = -1
+		el.cpu = -1
 		el.svr = s
 		el.poller = p
+		el.listeners = make(map[int]*listener)
 		el.eventHandler = s.eventHandler
-		if err = el.poller.AddRead(s.ln.packPollAttachment(s.accept)); err != nil {
-			return err
+		for _, ln := range streamLns {
+			el.listeners[ln.fd] = ln
+			if err = el.poller.AddRead(ln.packPollAttachment(el.accept)); err != nil {
+				return err
+			}
 		}
 		s.mainLoop = el
 
@@ -169,36 +327,82 @@ func (s *Server) runReactors(numEventLoop int) error {
 	return nil
 }
 
-func (s *Server) accept(fd int, _ IOEvent) error {
-	nfd, sa, err := unix.Accept(fd)
-	fmt.Println("开始一个新连接")
-	if err != nil {
-		if err == unix.EAGAIN {
-			return nil
+// 创建numEventLoop个event-loop并注册到负载均衡器中，需要读取UDP数据报时使用能放下一个完整数据报的读缓冲区
+func (s *Server) openEventLoops(numEventLoop int, readUDP bool) error {
+	var cpus []int
+	if s.opts.CPUAffinity {
+		var err error
+		if cpus, err = allowedCPUs(); err != nil {
+			return err
 		}
-		fmt.Printf("Accept() fails due to error: %v", err)
-		return errors.ErrAcceptSocket
 	}
-	if err = os.NewSyscallError("fcntl nonblock", unix.SetNonblock(nfd, true)); err != nil {
-		return err
+	for i := 0; i < numEventLoop; i++ {
+		if p, err := netpoll.OpenPoller(); err == nil {
+			el := new(eventLoop)
+			el.svr = s
+			el.cpu = -1
+			if len(cpus) > 0 {
+				el.cpu = cpus[i%len(cpus)]
+			}
+			el.poller = p
+			el.buffer = make([]byte, DefaultBufferSize)
+			if readUDP {
+				el.buffer = make([]byte, maxUDPPacketSize)
+			}
+			el.listeners = make(map[int]*listener)
+			el.connections = make(map[int]*conn)
+			el.timers = new(timingWheel)
+			el.eventHandler = s.eventHandler
+			s.lb.register(el)
+		} else {
+			return err
+		}
 	}
+	return nil
+}
 
-	remoteAddr := socket.SockaddrToTCPOrUnixAddr(sa)
-
-	el := s.lb.next(remoteAddr)
-	c := newTCPConn(nfd, el, sa, s.opts.Codec, el.ln.saddr.NetAddr, remoteAddr)
+// SO_REUSEPORT模式下没有主reactor，每个event-loop都绑定自己的监听socket，直接接收新连接，由内核在它们之间做负载均衡。
+// unix socket不支持SO_REUSEPORT，所有event-loop共用同一个监听socket
+func (s *Server) activateEventLoops(numEventLoop int) error {
+	readUDP := false
+	for _, ln := range s.lns {
+		readUDP = readUDP || ln.isUDP()
+	}
+	if err := s.openEventLoops(numEventLoop, readUDP); err != nil {
+		return err
+	}
 
-	err = el.poller.Trigger(el.register, c)
+	var err error
+	s.lb.iterate(func(i int, el *eventLoop) bool {
+		for _, ln := range s.lns[:len(s.addrs)] {
+			// 第一个event-loop直接使用Run中创建的监听器，其它的event-loop各自绑定一个新的监听器
+			if i > 0 && ln.isReusePort() {
+				if ln, err = initListener(ln.saddr, s.opts); err != nil {
+					return false
+				}
+				s.lns = append(s.lns, ln)
+			}
+			el.listeners[ln.fd] = ln
+			if err = el.poller.AddRead(ln.packPollAttachment(el.accept)); err != nil {
+				return false
+			}
+		}
+		return true
+	})
 	if err != nil {
-		_ = unix.Close(nfd)
-		c.releaseTCP()
+		return err
 	}
+
+	s.runSubReactors()
 	return nil
 }
 
 func (s *Server) runSubReactors() {
 
 	s.lb.iterate(func(i int, loop *eventLoop) bool {
+		// OnTick由第一个event-loop调用
+		loop.ticking = i == 0 && s.opts.Ticker
+		loop.poller.SetTimerHandler(loop.handleTimers)
 		s.wg.Add(1)
 		go func() {
 			loop.activateSubReactor()
@@ -211,13 +415,22 @@ func (s *Server) runSubReactors() {
 func (s *Server) signalShutdown() {
 	s.once.Do(func() {
 		s.cond.L.Lock()
+		s.signaled = true
 		s.cond.Signal()
 		s.cond.L.Unlock()
 	})
 }
 
+func (s *Server) closeListeners() {
+	for _, ln := range s.lns {
+		ln.close()
+	}
+}
+
 func (s *Server) closeEventLoops() {
 	s.lb.iterate(func(i int, el *eventLoop) bool {
+		// 启动失败时event-loop没有运行过，也要拒绝之后投递的任务
+		el.markClosed()
 		_ = el.poller.Close()
 		return true
 	})
@@ -229,25 +442,30 @@ func (s *Server) stop() {
 
 	s.eventHandler.OnShutdown(s)
 
-	// Notify all loops to close by closing all listeners
-	s.lb.iterate(func(i int, el *eventLoop) bool {
-		err := el.poller.Trigger(func(_ interface{}) error { return errors.ErrServerShutdown }, nil)
-		if err != nil {
-			fmt.Printf("failed to call UrgentTrigger on sub event-loop when stopping server: %v", err)
+	// 先关闭面向连接的监听器，停止接收新连接，UDP监听器还在被各个event-loop使用，等它们退出后再关闭
+	for _, ln := range s.lns {
+		if !ln.isUDP() {
+			ln.close()
 		}
-		return true
-	})
-
+	}
 	if s.mainLoop != nil {
-		s.ln.close()
 		err := s.mainLoop.poller.Trigger(func(_ interface{}) error { return errors.ErrServerShutdown }, nil)
 		if err != nil {
 			fmt.Printf("failed to call UrgentTrigger on main event-loop when stopping server: %v", err)
 		}
 	}
 
+	// 配置了ShutdownTimeout时，各个event-loop先把连接中积压的数据发送完毕，超时后再强制关闭所有连接
+	cancelDrain := func() {}
+	if s.opts.ShutdownTimeout > 0 {
+		cancelDrain = s.drainEventLoops(s.opts.ShutdownTimeout)
+	} else {
+		s.notifyEventLoops()
+	}
+
 	// Wait on all loops to complete reading events
 	s.wg.Wait()
+	cancelDrain()
 
 	s.closeEventLoops()
 
@@ -258,11 +476,51 @@ func (s *Server) stop() {
 		}
 	}
 
-	atomic.StoreInt32(&s.inShutdown, 1)
+	s.deleteServer()
+}
+
+// 让所有的event-loop进入排空阶段，超过timeout后通知它们退出。
+// 返回的函数用于在所有event-loop退出后停止计时，它会等待计时协程结束，保证之后不会再往已关闭的轮询器投递任务
+func (s *Server) drainEventLoops(timeout time.Duration) (cancel func()) {
+	s.lb.iterate(func(i int, el *eventLoop) bool {
+		if err := el.poller.Trigger(el.drain, nil); err != nil {
+			fmt.Printf("failed to call Trigger on sub event-loop when draining connections: %v", err)
+		}
+		return true
+	})
+
+	stopped, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			s.notifyEventLoops()
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+		<-done
+	}
+}
+
+// 通知所有的event-loop退出，退出时会强制关闭剩余的连接
+func (s *Server) notifyEventLoops() {
+	s.lb.iterate(func(i int, el *eventLoop) bool {
+		err := el.poller.Trigger(func(_ interface{}) error { return errors.ErrServerShutdown }, nil)
+		if err != nil {
+			fmt.Printf("failed to call UrgentTrigger on sub event-loop when stopping server: %v", err)
+		}
+		return true
+	})
 }
 
 func (s *Server) waitForShutdown() {
 	s.cond.L.Lock()
-	s.cond.Wait()
+	for !s.signaled {
+		s.cond.Wait()
+	}
 	s.cond.L.Unlock()
 }
@@ -0,0 +1,212 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"greactor/src/core/icodecs"
+	"greactor/src/errors"
+	"testing"
+)
+
+func TestLengthFieldBasedFrameCodec(test *testing.T) {
+	for _, size := range []int{1, 2, 3, 4, 8} {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			codec := icodecs.NewLengthFieldBasedFrameCodec(
+				icodecs.EncoderConfig{ByteOrder: order, LengthFieldLength: size},
+				icodecs.DecoderConfig{ByteOrder: order, LengthFieldLength: size, InitialBytesToStrip: size},
+			)
+			payload := []byte("greactor")
+			packet, err := codec.Encode(payload)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if len(packet) != size+len(payload) {
+				test.Fatalf("size=%d: unexpected packet length %d", size, len(packet))
+			}
+
+			// 数据不完整时需要等待更多的数据
+			if _, _, err = codec.Decode(packet[:len(packet)-1]); err != errors.ErrIncompletePacket {
+				test.Fatalf("size=%d: expected ErrIncompletePacket, got %v", size, err)
+			}
+
+			// 两个报文粘在一起时只解出第一个
+			stream := append(append([]byte{}, packet...), packet...)
+			frame, n, err := codec.Decode(stream)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if n != len(packet) || !bytes.Equal(frame, payload) {
+				test.Fatalf("size=%d: unexpected frame %q, consumed %d", size, frame, n)
+			}
+		}
+	}
+}
+
+// 包装过的小端字节序，不能通过和binary.LittleEndian比较识别出来
+type wrappedLittleEndian struct {
+	binary.ByteOrder
+}
+
+func TestLengthFieldBasedFrameCodecWrappedOrder(test *testing.T) {
+	order := wrappedLittleEndian{binary.LittleEndian}
+	codec := icodecs.NewLengthFieldBasedFrameCodec(
+		icodecs.EncoderConfig{ByteOrder: order, LengthFieldLength: 3},
+		icodecs.DecoderConfig{ByteOrder: order, LengthFieldLength: 3, InitialBytesToStrip: 3},
+	)
+	packet, err := codec.Encode([]byte("greactor"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !bytes.Equal(packet[:3], []byte{8, 0, 0}) {
+		test.Fatalf("unexpected length field %v", packet[:3])
+	}
+	frame, n, err := codec.Decode(packet)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if n != len(packet) || string(frame) != "greactor" {
+		test.Fatalf("unexpected frame %q, consumed %d", frame, n)
+	}
+}
+
+func TestLengthFieldBasedFrameCodecWithHeader(test *testing.T) {
+	// 报文格式：2字节魔数 + 4字节长度(包含报文头) + 报文体
+	codec := icodecs.NewLengthFieldBasedFrameCodec(
+		icodecs.EncoderConfig{LengthFieldLength: 4},
+		icodecs.DecoderConfig{LengthFieldOffset: 2, LengthFieldLength: 4, LengthAdjustment: -6, InitialBytesToStrip: 6, MaxFrameLength: 16},
+	)
+	packet := []byte{0xca, 0xfe, 0, 0, 0, 10, 'a', 'b', 'c', 'd'}
+	frame, n, err := codec.Decode(packet)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if n != len(packet) || string(frame) != "abcd" {
+		test.Fatalf("unexpected frame %q, consumed %d", frame, n)
+	}
+
+	if _, _, err = codec.Decode([]byte{0xca, 0xfe, 0, 0, 0, 32}); err != errors.ErrTooLongFrame {
+		test.Fatalf("expected ErrTooLongFrame, got %v", err)
+	}
+	if _, _, err = codec.Decode([]byte{0xca, 0xfe, 0, 0, 0, 2}); err != errors.ErrTooLessLength {
+		test.Fatalf("expected ErrTooLessLength, got %v", err)
+	}
+
+	overflow := icodecs.NewLengthFieldBasedFrameCodec(icodecs.EncoderConfig{LengthFieldLength: 1}, icodecs.DecoderConfig{LengthFieldLength: 1})
+	if _, err = overflow.Encode(make([]byte, 256)); err != errors.ErrLengthFieldOverflow {
+		test.Fatalf("expected ErrLengthFieldOverflow, got %v", err)
+	}
+	unsupported := icodecs.NewLengthFieldBasedFrameCodec(icodecs.EncoderConfig{LengthFieldLength: 5}, icodecs.DecoderConfig{LengthFieldLength: 5})
+	if _, _, err = unsupported.Decode(make([]byte, 8)); err != errors.ErrUnsupportedLength {
+		test.Fatalf("expected ErrUnsupportedLength, got %v", err)
+	}
+}
+
+func TestDelimiterBasedFrameCodec(test *testing.T) {
+	codec := icodecs.NewDelimiterBasedFrameCodec([]byte("$$"), 8, true)
+	packet, err := codec.Encode([]byte("abc"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(packet) != "abc$$" {
+		test.Fatalf("unexpected packet %q", packet)
+	}
+
+	frame, n, err := codec.Decode([]byte("abc$$def$"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(frame) != "abc" || n != 5 {
+		test.Fatalf("unexpected frame %q, consumed %d", frame, n)
+	}
+	if _, _, err = codec.Decode([]byte("def$")); err != errors.ErrIncompletePacket {
+		test.Fatalf("expected ErrIncompletePacket, got %v", err)
+	}
+	// 最大长度的报文后面跟着只到达了一半的分隔符
+	if _, _, err = codec.Decode([]byte("12345678$")); err != errors.ErrIncompletePacket {
+		test.Fatalf("expected ErrIncompletePacket, got %v", err)
+	}
+	if frame, _, err = codec.Decode([]byte("12345678$$")); err != nil || string(frame) != "12345678" {
+		test.Fatalf("unexpected frame %q, err %v", frame, err)
+	}
+	if _, _, err = codec.Decode([]byte("1234567890")); err != errors.ErrTooLongFrame {
+		test.Fatalf("expected ErrTooLongFrame, got %v", err)
+	}
+
+	keep := icodecs.NewDelimiterBasedFrameCodec([]byte{0}, 0, false)
+	if frame, n, err = keep.Decode([]byte{'a', 0, 'b'}); err != nil || string(frame) != "a\x00" || n != 2 {
+		test.Fatalf("unexpected frame %q, consumed %d, err %v", frame, n, err)
+	}
+
+	expectPanic(test, "empty delimiter", func() { icodecs.NewDelimiterBasedFrameCodec(nil, 0, false) })
+}
+
+// 检查fn会panic
+func expectPanic(test *testing.T, what string, fn func()) {
+	defer func() {
+		if recover() == nil {
+			test.Fatalf("%s: expected panic", what)
+		}
+	}()
+	fn()
+}
+
+func TestLineBasedFrameCodec(test *testing.T) {
+	codec := icodecs.NewLineBasedFrameCodec(5, true)
+	packet, err := codec.Encode([]byte("get k"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(packet) != "get k\r\n" {
+		test.Fatalf("unexpected packet %q", packet)
+	}
+
+	stream := []byte("get a\r\nquit\nget")
+	var lines []string
+	for {
+		frame, n, err := codec.Decode(stream)
+		if err == errors.ErrIncompletePacket {
+			break
+		}
+		if err != nil {
+			test.Fatal(err)
+		}
+		lines = append(lines, string(frame))
+		stream = stream[n:]
+	}
+	if len(lines) != 2 || lines[0] != "get a" || lines[1] != "quit" || string(stream) != "get" {
+		test.Fatalf("unexpected lines %q, remaining %q", lines, stream)
+	}
+
+	if _, _, err = codec.Decode([]byte("get abc\n")); err != errors.ErrTooLongFrame {
+		test.Fatalf("expected ErrTooLongFrame, got %v", err)
+	}
+	if _, _, err = codec.Decode([]byte("get abc")); err != errors.ErrTooLongFrame {
+		test.Fatalf("expected ErrTooLongFrame, got %v", err)
+	}
+
+	keep := icodecs.NewLineBasedFrameCodec(0, false)
+	if frame, _, err := keep.Decode([]byte("quit\r\n")); err != nil || string(frame) != "quit\r\n" {
+		test.Fatalf("unexpected frame %q, err %v", frame, err)
+	}
+}
+
+func TestFixedLengthFrameCodec(test *testing.T) {
+	codec := icodecs.NewFixedLengthFrameCodec(4)
+	if _, err := codec.Encode([]byte("abcdefgh")); err != nil {
+		test.Fatal(err)
+	}
+	if _, err := codec.Encode([]byte("abcde")); err != errors.ErrInvalidFixedLength {
+		test.Fatalf("expected ErrInvalidFixedLength, got %v", err)
+	}
+
+	frame, n, err := codec.Decode([]byte("abcdef"))
+	if err != nil || string(frame) != "abcd" || n != 4 {
+		test.Fatalf("unexpected frame %q, consumed %d, err %v", frame, n, err)
+	}
+	if _, _, err = codec.Decode([]byte("ef")); err != errors.ErrIncompletePacket {
+		test.Fatalf("expected ErrIncompletePacket, got %v", err)
+	}
+
+	expectPanic(test, "zero frame length", func() { icodecs.NewFixedLengthFrameCodec(0) })
+	expectPanic(test, "negative frame length", func() { icodecs.NewFixedLengthFrameCodec(-1) })
+}
@@ -1,9 +1,22 @@
 package test
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"golang.org/x/sys/unix"
 	"greactor/src/core"
+	"greactor/src/errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 type testServer struct {
@@ -21,11 +34,1532 @@ func (es *testServer) OnOpened(c core.Conn) (out []byte, action core.Action) {
 	return
 }
 
+// 不断尝试连接服务器，直到服务器启动完成
+func dial(test *testing.T, network, addr string) net.Conn {
+	for i := 0; i < 50; i++ {
+		if c, err := net.Dial(network, addr); err == nil {
+			return c
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	test.Fatalf("failed to connect to %s://%s", network, addr)
+	return nil
+}
+
+// 测试中使用的socket缓冲区大小，缓冲区很小时不需要发送很多数据就能把它们写满
+const smallSocketBuffer = 16 * 1024
+
+// 连接之前把接收缓冲区设置得很小，客户端不读取数据时服务器发送的数据会很快积压在服务器一端
+func dialSmallRecvBuffer(test *testing.T, addr string) net.Conn {
+	d := net.Dialer{Control: func(network, address string, rc syscall.RawConn) error {
+		var err error
+		if cerr := rc.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, smallSocketBuffer)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		test.Fatal(err)
+	}
+	return c
+}
+
+// 在OnInitComplete中记录服务器实际监听的地址
+type addrsNotifier struct {
+	core.EventHandler
+	addrs chan []net.Addr
+}
+
+func (h *addrsNotifier) OnInitComplete(s *core.Server) (action core.Action) {
+	h.addrs <- s.Addrs()
+	return h.EventHandler.OnInitComplete(s)
+}
+
+// 测试中运行的服务器
+type runningServer struct {
+	*core.Server
+	addrs []net.Addr // 服务器实际监听的地址，与传入的protoAddrs一一对应
+	done  chan error
+	once  sync.Once
+	err   error
+}
+
+// 第一个监听地址
+func (rs *runningServer) addr() string {
+	return rs.addrs[0].String()
+}
+
+// 等待Run返回，返回Run的返回值
+func (rs *runningServer) wait() error {
+	rs.once.Do(func() {
+		select {
+		case rs.err = <-rs.done:
+		case <-time.After(10 * time.Second):
+			rs.err = fmt.Errorf("server did not stop")
+		}
+	})
+	return rs.err
+}
+
+// 启动服务器并等待初始化完成，端口为0时由内核分配。测试结束时关闭服务器并检查Run的返回值
+func startServer(test *testing.T, protoAddr string, eh core.EventHandler, opts *core.Options) *runningServer {
+	return startMultiAddrServer(test, []string{protoAddr}, eh, opts)
+}
+
+func startMultiAddrServer(test *testing.T, protoAddrs []string, eh core.EventHandler, opts *core.Options) *runningServer {
+	h := &addrsNotifier{EventHandler: eh, addrs: make(chan []net.Addr, 1)}
+	s, err := core.NewMultiAddrServer(h, protoAddrs, opts)
+	if err != nil {
+		test.Fatal(err)
+	}
+	rs := &runningServer{Server: s, done: make(chan error, 1)}
+	go func() { rs.done <- s.Run() }()
+	test.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Stop(ctx)
+		if err := rs.wait(); err != nil {
+			test.Error(err)
+		}
+	})
+
+	select {
+	case rs.addrs = <-h.addrs:
+	case err = <-rs.done:
+		rs.once.Do(func() {})
+		test.Fatalf("server failed to start: %v", err)
+	case <-time.After(3 * time.Second):
+		test.Fatal("server did not start")
+	}
+	return rs
+}
+
 func TestServer(test *testing.T) {
 	echo := new(testServer)
 	opts := new(core.Options)
 	opts.Multicore = true
 
-	s, _ := core.NewServer(echo, "tcp://:8332", opts)
-	s.Run()
+	rs := startServer(test, "tcp://127.0.0.1:0", echo, opts)
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("hello greactor")); err != nil {
+		test.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := c.Read(buf)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(buf[:n]) != "hello greactor" {
+		test.Fatalf("unexpected echo: %q", buf[:n])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = core.Stop(ctx, "tcp://127.0.0.1:0"); err != nil {
+		test.Fatal(err)
+	}
+	if err = rs.wait(); err != nil {
+		test.Fatal(err)
+	}
+	if err = rs.Stop(ctx); err != errors.ErrServerInShutdown {
+		test.Fatalf("expected ErrServerInShutdown, got %v", err)
+	}
+	if err = core.Stop(ctx, "tcp://127.0.0.1:0"); err != errors.ErrServerNotFound {
+		test.Fatalf("expected ErrServerNotFound, got %v", err)
+	}
+}
+
+func TestStopByAddress(test *testing.T) {
+	// 两个服务器用同一个地址登记，后启动的服务器覆盖先启动的
+	first := startServer(test, "tcp://127.0.0.1:0", new(testServer), new(core.Options))
+	second := startServer(test, "tcp://127.0.0.1:0", new(testServer), new(core.Options))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := first.Stop(ctx); err != nil {
+		test.Fatal(err)
+	}
+	if err := first.wait(); err != nil {
+		test.Fatal(err)
+	}
+	// 先启动的服务器关闭时不能删除后启动的服务器的登记
+	if err := core.Stop(ctx, "tcp://127.0.0.1:0"); err != nil {
+		test.Fatal(err)
+	}
+	if err := second.wait(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestStopWithoutRun(test *testing.T) {
+	// Run之前调用Stop会立即返回，之后Run也会直接返回
+	s, err := core.NewServer(new(testServer), "tcp://127.0.0.1:0", new(core.Options))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err = s.Stop(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+	if err = s.Run(); err != errors.ErrServerInShutdown {
+		test.Fatalf("expected ErrServerInShutdown, got %v", err)
+	}
+
+	// Run启动失败之后调用Stop也会立即返回
+	s, err = core.NewServer(new(testServer), "tcp://127.0.0.1:0", &core.Options{NumEventLoop: 10001, LockOSThread: true})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err = s.Run(); err != errors.ErrTooManyEventLoopThreads {
+		test.Fatalf("expected ErrTooManyEventLoopThreads, got %v", err)
+	}
+	if err = s.Stop(context.Background()); err != errors.ErrServerInShutdown {
+		test.Fatalf("expected ErrServerInShutdown, got %v", err)
+	}
+}
+
+// 在OnOpened中记录连接的地址，用Context保存每个连接收到的报文数量
+type sessionServer struct {
+	core.EventServer
+	addrs chan [2]net.Addr
+}
+
+func (es *sessionServer) OnOpened(c core.Conn) (out []byte, action core.Action) {
+	es.addrs <- [2]net.Addr{c.LocalAddr(), c.RemoteAddr()}
+	c.SetContext(0)
+	return
+}
+
+func (es *sessionServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	count := c.Context().(int) + 1
+	c.SetContext(count)
+	out = []byte(strconv.Itoa(count))
+	return
+}
+
+func TestConnAddrAndContext(test *testing.T) {
+	es := &sessionServer{addrs: make(chan [2]net.Addr, 1)}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, new(core.Options))
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+
+	select {
+	case addrs := <-es.addrs:
+		if addrs[0].String() != c.RemoteAddr().String() {
+			test.Fatalf("unexpected local address %v, expected %v", addrs[0], c.RemoteAddr())
+		}
+		if addrs[1].String() != c.LocalAddr().String() {
+			test.Fatalf("unexpected remote address %v, expected %v", addrs[1], c.LocalAddr())
+		}
+	case <-time.After(3 * time.Second):
+		test.Fatal("OnOpened was not called")
+	}
+
+	// 连接上的上下文在多次回调之间保留
+	buf := make([]byte, 1)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for _, expected := range []string{"1", "2", "3"} {
+		if _, err := c.Write([]byte("x")); err != nil {
+			test.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, buf); err != nil {
+			test.Fatal(err)
+		}
+		if string(buf) != expected {
+			test.Fatalf("unexpected count %q, expected %q", buf, expected)
+		}
+	}
+}
+
+type bulkServer struct {
+	core.EventServer
+	payload []byte
+}
+
+func (es *bulkServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	out = es.payload
+	return
+}
+
+// 记录每次OnClosed
+type resetServer struct {
+	bulkServer
+	closed chan error
+}
+
+func (es *resetServer) OnClosed(c core.Conn, err error) (action core.Action) {
+	es.closed <- err
+	return
+}
+
+// 发送积压的数据时对端重置连接，flush失败关闭连接之后不能再读取已经关闭的fd
+func TestFlushAfterReset(test *testing.T) {
+	es := &resetServer{bulkServer: bulkServer{payload: make([]byte, 256*1024)}, closed: make(chan error, 4)}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, &core.Options{SocketSendBuffer: smallSocketBuffer})
+	c := dialSmallRecvBuffer(test, rs.addr())
+	if _, err := c.Write([]byte("bulk")); err != nil {
+		test.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// 接收缓冲区中还有没读取的数据，关闭时发送RST
+	_ = c.(*net.TCPConn).SetLinger(0)
+	_ = c.Close()
+
+	select {
+	case <-es.closed:
+	case <-time.After(3 * time.Second):
+		test.Fatal("connection was not closed")
+	}
+	select {
+	case err := <-es.closed:
+		test.Fatalf("OnClosed called twice, second error: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestServerDrainOnStop(test *testing.T) {
+	bulk := &bulkServer{payload: make([]byte, 256*1024)}
+	opts := &core.Options{ShutdownTimeout: 5 * time.Second, SocketSendBuffer: smallSocketBuffer}
+
+	rs := startServer(test, "tcp://127.0.0.1:0", bulk, opts)
+	c := dialSmallRecvBuffer(test, rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("x")); err != nil {
+		test.Fatal(err)
+	}
+	// 等待服务器把数据写满socket缓冲区，剩余的数据积压在outboundBuffer中
+	time.Sleep(200 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		stopped <- rs.Stop(ctx)
+	}()
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, total := make([]byte, 64*1024), 0
+	for {
+		n, err := c.Read(buf)
+		total += n
+		if err != nil {
+			break
+		}
+	}
+	if total != len(bulk.payload) {
+		test.Fatalf("expected %d bytes before close, got %d", len(bulk.payload), total)
+	}
+	if err := <-stopped; err != nil {
+		test.Fatal(err)
+	}
+	if err := rs.wait(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+// 发送积压的数据，一段时间后由用户代码在定时器中关闭连接
+type closingBulkServer struct {
+	bulkServer
+}
+
+func (es *closingBulkServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	c.AfterFunc(400*time.Millisecond, func() { _ = c.Close(nil) })
+	return es.bulkServer.React(frame, c)
+}
+
+func TestConnCloseWhileDraining(test *testing.T) {
+	es := &closingBulkServer{bulkServer{payload: make([]byte, 256*1024)}}
+	opts := &core.Options{ShutdownTimeout: 10 * time.Second, SocketSendBuffer: smallSocketBuffer}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, opts)
+
+	// 客户端不读取数据，连接在排空阶段被用户代码关闭，不需要等到ShutdownTimeout
+	c := dialSmallRecvBuffer(test, rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("x")); err != nil {
+		test.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := rs.Stop(ctx); err != nil {
+		test.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		test.Fatalf("draining should finish once the connection is closed, took %v", elapsed)
+	}
+}
+
+type pushServer struct {
+	core.EventServer
+	conns chan core.Conn
+	woken chan struct{}
+}
+
+func (es *pushServer) OnOpened(c core.Conn) (out []byte, action core.Action) {
+	es.conns <- c
+	return
+}
+
+func (es *pushServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	if frame == nil {
+		close(es.woken)
+	}
+	return
+}
+
+func TestConnAsyncWrite(test *testing.T) {
+	push := &pushServer{conns: make(chan core.Conn, 1), woken: make(chan struct{})}
+	rs := startServer(test, "tcp://127.0.0.1:0", push, new(core.Options))
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	sc := <-push.conns
+
+	written := make(chan error, 1)
+	if err := sc.AsyncWrite([]byte("push"), func(_ core.Conn, err error) { written <- err }); err != nil {
+		test.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := c.Read(buf)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(buf[:n]) != "push" {
+		test.Fatalf("unexpected message: %q", buf[:n])
+	}
+	if err = <-written; err != nil {
+		test.Fatal(err)
+	}
+
+	if err = sc.Wake(); err != nil {
+		test.Fatal(err)
+	}
+	select {
+	case <-push.woken:
+	case <-time.After(3 * time.Second):
+		test.Fatal("React was not called after Wake")
+	}
+
+	// 服务器关闭之后不能再向event-loop投递任务
+	_ = rs.Stop(context.Background())
+	if err = rs.wait(); err != nil {
+		test.Fatal(err)
+	}
+	if err = sc.AsyncWrite([]byte("push"), nil); err != errors.ErrServerShutdown {
+		test.Fatalf("AsyncWrite: expected ErrServerShutdown, got %v", err)
+	}
+	if err = sc.Wake(); err != errors.ErrServerShutdown {
+		test.Fatalf("Wake: expected ErrServerShutdown, got %v", err)
+	}
+	if err = sc.SetDeadline(time.Now()); err != errors.ErrServerShutdown {
+		test.Fatalf("SetDeadline: expected ErrServerShutdown, got %v", err)
+	}
+}
+
+type writevServer struct {
+	core.EventServer
+}
+
+func (es *writevServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	_ = c.Writev([][]byte{[]byte("header:"), frame})
+	return
+}
+
+func TestConnWritev(test *testing.T) {
+	rs := startServer(test, "tcp://127.0.0.1:0", new(writevServer), new(core.Options))
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("body")); err != nil {
+		test.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := io.ReadFull(c, buf[:len("header:body")])
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(buf[:n]) != "header:body" {
+		test.Fatalf("unexpected message: %q", buf[:n])
+	}
+}
+
+// 在React中关闭连接后继续写入
+type closedWriteServer struct {
+	core.EventServer
+	errs chan error
+}
+
+func (es *closedWriteServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	_ = c.Close(nil)
+	es.errs <- c.Write(frame)
+	es.errs <- c.Writev([][]byte{frame})
+	return
+}
+
+func TestConnWriteAfterClose(test *testing.T) {
+	es := &closedWriteServer{errs: make(chan error, 2)}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, new(core.Options))
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		test.Fatal(err)
+	}
+	for _, name := range []string{"Write", "Writev"} {
+		select {
+		case err := <-es.errs:
+			if err != errors.ErrConnectionClosed {
+				test.Fatalf("%s: expected ErrConnectionClosed, got %v", name, err)
+			}
+		case <-time.After(3 * time.Second):
+			test.Fatal("React was not called")
+		}
+	}
+}
+
+// 以'\n'作为分隔符的简单编解码器
+type newlineCodec struct{}
+
+func (cc *newlineCodec) Encode(buf []byte) ([]byte, error) {
+	return append(buf, '\n'), nil
+}
+
+func (cc *newlineCodec) Decode(buf []byte) ([]byte, int, error) {
+	for i, b := range buf {
+		if b == '\n' {
+			return buf[:i], i + 1, nil
+		}
+	}
+	return nil, 0, errors.ErrIncompletePacket
+}
+
+func TestServerPipelinedFrames(test *testing.T) {
+	opts := &core.Options{Codec: new(newlineCodec)}
+	rs := startServer(test, "tcp://127.0.0.1:0", new(testServer), opts)
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	// 一次发送多个报文，最后一个报文不完整
+	if _, err := c.Write([]byte("get a\nget b\nget c\nget")); err != nil {
+		test.Fatal(err)
+	}
+	expected := "get a\nget b\nget c\n"
+	buf := make([]byte, len(expected))
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		test.Fatal(err)
+	}
+	if string(buf) != expected {
+		test.Fatalf("unexpected replies: %q", buf)
+	}
+
+	if _, err := c.Write([]byte(" d\n")); err != nil {
+		test.Fatal(err)
+	}
+	buf = buf[:len("get d\n")]
+	if _, err := io.ReadFull(c, buf); err != nil {
+		test.Fatal(err)
+	}
+	if string(buf) != "get d\n" {
+		test.Fatalf("unexpected reply: %q", buf)
+	}
+}
+
+// 原始读取模式下自己解析报文：2字节的长度字段加上报文内容，长度字段和内容可以在不同的读事件中分别消费
+type rawServer struct {
+	core.EventServer
+}
+
+func (es *rawServer) React(packet []byte, c core.Conn) (out []byte, action core.Action) {
+	for {
+		// 上一次读事件中已经消费了长度字段，长度保存在Context中
+		if c.Context() == nil {
+			header, err := c.Next(2)
+			if err != nil {
+				return
+			}
+			// 返回的切片容量被限制，追加数据不会覆盖缓冲区中的报文内容
+			_ = append(header, 0)
+			c.SetContext(int(binary.BigEndian.Uint16(header)))
+		}
+		body, err := c.Next(c.Context().(int))
+		if err != nil {
+			return
+		}
+		c.SetContext(nil)
+		out = append(out, body...)
+	}
+}
+
+func TestRawRead(test *testing.T) {
+	rs := startServer(test, "tcp://127.0.0.1:0", new(rawServer), &core.Options{RawRead: true})
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+
+	// 长度字段、报文内容的前半部分和后半部分分三次到达
+	for _, part := range []string{"\x00\x05", "hel", "lo"} {
+		if _, err := c.Write([]byte(part)); err != nil {
+			test.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	buf := make([]byte, 5)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		test.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		test.Fatalf("unexpected reply: %q", buf)
+	}
+
+	// 一次到达多个完整的报文和下一个报文的长度字段
+	if _, err := c.Write([]byte("\x00\x01a\x00\x02bc\x00\x03")); err != nil {
+		test.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := c.Write([]byte("def")); err != nil {
+		test.Fatal(err)
+	}
+	buf = make([]byte, 6)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		test.Fatal(err)
+	}
+	if string(buf) != "abcdef" {
+		test.Fatalf("unexpected reply: %q", buf)
+	}
+}
+
+type udpServer struct {
+	core.EventServer
+}
+
+func (es *udpServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	if _, ok := c.RemoteAddr().(*net.UDPAddr); !ok {
+		return []byte("bad remote addr"), core.None
+	}
+	switch string(frame) {
+	case "loop":
+		return []byte(strconv.Itoa(c.LoopIndex())), core.None
+	case "shutdown":
+		return nil, core.Shutdown
+	}
+	out = append([]byte("echo:"), frame...)
+	return
+}
+
+func TestUDPServer(test *testing.T) {
+	rs := startServer(test, "udp://127.0.0.1:0", new(udpServer), &core.Options{NumEventLoop: 4})
+	c, err := net.Dial("udp", rs.addr())
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer c.Close()
+	request := func(msg string) string {
+		// 服务器的socket在初始化完成时已经绑定，数据报会在接收缓冲区中等待event-loop启动
+		if _, err := c.Write([]byte(msg)); err != nil {
+			test.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			test.Fatalf("no reply from UDP server: %v", err)
+		}
+		return string(buf[:n])
+	}
+	if reply := request("ping"); reply != "echo:ping" {
+		test.Fatalf("unexpected reply: %q", reply)
+	}
+
+	// UDP监听器只注册在一个event-loop上
+	for i := 0; i < 8; i++ {
+		if reply := request("loop"); reply != "0" {
+			test.Fatalf("datagram should be read by loop 0, got %q", reply)
+		}
+	}
+
+	// React返回Shutdown时关闭服务器
+	if _, err = c.Write([]byte("shutdown")); err != nil {
+		test.Fatal(err)
+	}
+	if err = rs.wait(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+// 向服务器的每个监听地址发送一条消息并检查回显的内容
+func expectEcho(test *testing.T, rs *runningServer) {
+	for _, addr := range rs.addrs {
+		c := dial(test, addr.Network(), addr.String())
+		if _, err := c.Write([]byte("ping")); err != nil {
+			test.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := io.ReadFull(c, buf)
+		_ = c.Close()
+		if err != nil {
+			test.Fatal(err)
+		}
+		if string(buf) != "ping" {
+			test.Fatalf("unexpected echo: %q", buf)
+		}
+	}
+}
+
+// 启动一个回显服务器，发送一条消息并检查回显的内容，然后关闭服务器
+func echoOnce(test *testing.T, protoAddr string, opts *core.Options) {
+	rs := startServer(test, protoAddr, new(testServer), opts)
+	expectEcho(test, rs)
+	_ = rs.Stop(context.Background())
+	if err := rs.wait(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestUnixServer(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "Greactor.sock")
+
+	// 模拟上次进程异常退出时遗留下来的socket文件
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		test.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	echoOnce(test, "unix://"+path, new(core.Options))
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		test.Fatalf("socket file should be removed after shutdown, got %v", err)
+	}
+
+	echoOnce(test, "unix://@greactor-test", new(core.Options))
+}
+
+func TestUnixSocketPerm(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "perm.sock")
+	startServer(test, "unix://"+path, new(testServer), &core.Options{UnixSocketPerm: 0600})
+	c := dial(test, "unix", path)
+	defer c.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		test.Fatalf("unexpected socket file permission: %v", fi.Mode().Perm())
+	}
+}
+
+// 把连接所属监听器的地址回复给客户端
+type listenerAddrServer struct {
+	core.EventServer
+}
+
+func (es *listenerAddrServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	return []byte(c.ListenerAddr().String() + "\n"), core.None
+}
+
+func TestMultiAddrServer(test *testing.T) {
+	if _, err := core.NewMultiAddrServer(new(listenerAddrServer), nil, new(core.Options)); err != errors.ErrNoAddresses {
+		test.Fatalf("expected ErrNoAddresses, got %v", err)
+	}
+
+	path := filepath.Join(test.TempDir(), "multi.sock")
+	protoAddrs := []string{"udp://127.0.0.1:0", "tcp://127.0.0.1:0", "unix://" + path}
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		_ = ln.Close()
+		protoAddrs = append(protoAddrs, "tcp6://[::1]:0")
+	}
+
+	rs := startMultiAddrServer(test, protoAddrs, new(listenerAddrServer), &core.Options{Multicore: true})
+	// 跳过UDP地址
+	for i, addr := range rs.addrs[1:] {
+		c := dial(test, addr.Network(), addr.String())
+		if _, err := c.Write([]byte("who")); err != nil {
+			test.Fatal(err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		reply, err := bufio.NewReader(c).ReadString('\n')
+		_ = c.Close()
+		if err != nil {
+			test.Fatal(err)
+		}
+		if reply != addr.String()+"\n" {
+			test.Fatalf("%s: unexpected listener address %q", protoAddrs[i+1], reply)
+		}
+	}
+
+	// 通过任意一个地址都能关闭服务器
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := core.Stop(ctx, protoAddrs[len(protoAddrs)-1]); err != nil {
+		test.Fatal(err)
+	}
+	if err := rs.wait(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestReusePortServer(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "reuseport.sock")
+	opts := &core.Options{ReusePort: true, Multicore: true}
+	rs := startMultiAddrServer(test, []string{"tcp://127.0.0.1:0", "unix://" + path}, new(testServer), opts)
+	for i := 0; i < 8; i++ {
+		expectEcho(test, rs)
+	}
+}
+
+func TestReusePortAcceptEMFILE(test *testing.T) {
+	rs := startServer(test, "tcp://127.0.0.1:0", new(testServer), &core.Options{ReusePort: true})
+
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		test.Fatal(err)
+	}
+	// 找到下一个可用的fd，限制进程的fd数量，让客户端的连接刚好用掉最后一个fd，服务器accept时返回EMFILE
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		test.Fatal(err)
+	}
+	next := f.Fd()
+	_ = f.Close()
+	lowered := limit
+	lowered.Cur = uint64(next) + 1
+	if err = unix.Setrlimit(unix.RLIMIT_NOFILE, &lowered); err != nil {
+		test.Fatal(err)
+	}
+	c, err := net.Dial("tcp", rs.addr())
+	time.Sleep(50 * time.Millisecond)
+	if rerr := unix.Setrlimit(unix.RLIMIT_NOFILE, &limit); rerr != nil {
+		test.Fatal(rerr)
+	}
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer c.Close()
+
+	// 恢复限制之后服务器能接收积压的连接，并且没有退出
+	if _, err = c.Write([]byte("ping")); err != nil {
+		test.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = io.ReadFull(c, buf); err != nil {
+		test.Fatal(err)
+	}
+	expectEcho(test, rs)
+}
+
+func TestReusePortLoadSpread(test *testing.T) {
+	es := &loopIndexServer{opened: make(chan int, 32)}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, &core.Options{ReusePort: true, NumEventLoop: 4})
+	addr := rs.addrs[0]
+	if addr.(*net.TCPAddr).Port == 0 {
+		test.Fatal("expected the port assigned by the kernel")
+	}
+
+	// 所有event-loop的监听器绑定在同一个端口上，内核会把连接分散到各个event-loop
+	loops := make(map[int]bool)
+	for i := 0; i < 32; i++ {
+		c := dial(test, "tcp", addr.String())
+		defer c.Close()
+		select {
+		case idx := <-es.opened:
+			loops[idx] = true
+		case <-time.After(3 * time.Second):
+			test.Fatal("connection was not accepted")
+		}
+	}
+	if len(loops) < 2 {
+		test.Fatalf("connections should be accepted on more than one loop, got %v", loops)
+	}
+}
+
+// 总是选择最后一个event-loop，并记录选择时它上面的连接数
+type pinLoadBalancer struct {
+	mu      sync.Mutex
+	counts  []int
+	numLoop int
+}
+
+func (lb *pinLoadBalancer) Next(_ net.Addr, loops []core.LoopInfo) int {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	last := loops[len(loops)-1]
+	lb.numLoop = len(loops)
+	lb.counts = append(lb.counts, last.ConnCount())
+	return last.Index()
+}
+
+// 记录每个连接所属的event-loop
+type loopIndexServer struct {
+	core.EventServer
+	opened chan int
+}
+
+func (es *loopIndexServer) OnOpened(c core.Conn) (out []byte, action core.Action) {
+	es.opened <- c.LoopIndex()
+	return
+}
+
+func (es *loopIndexServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	out = frame
+	return
+}
+
+func TestCustomLoadBalancer(test *testing.T) {
+	lb := new(pinLoadBalancer)
+	es := &loopIndexServer{opened: make(chan int, 8)}
+	opts := &core.Options{NumEventLoop: 4, LB: core.LeastConnections, CustomLB: lb}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, opts)
+
+	// 连接保持打开，之后的连接选择event-loop时可以看到它们
+	for i := 0; i < 3; i++ {
+		conn := dial(test, "tcp", rs.addr())
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			test.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			test.Fatal(err)
+		}
+		if idx := <-es.opened; idx != 3 {
+			test.Fatalf("connection %d should be pinned to loop 3, landed on %d", i, idx)
+		}
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.numLoop != 4 {
+		test.Fatalf("expected 4 event-loops, got %d", lb.numLoop)
+	}
+	if len(lb.counts) != 3 || lb.counts[0] != 0 || lb.counts[1] != 1 || lb.counts[2] != 2 {
+		test.Fatalf("unexpected connection counts: %v", lb.counts)
+	}
+}
+
+// 记录连接关闭时所在的event-loop
+type loopCloseServer struct {
+	loopIndexServer
+	closed chan int
+}
+
+func (es *loopCloseServer) OnClosed(c core.Conn, err error) (action core.Action) {
+	es.closed <- c.LoopIndex()
+	return
+}
+
+func TestLeastConnectionsLoadBalancer(test *testing.T) {
+	es := &loopCloseServer{loopIndexServer{opened: make(chan int, 8)}, make(chan int, 8)}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, &core.Options{NumEventLoop: 4, LB: core.LeastConnections})
+
+	// 逐个建立连接，返回连接被分配到的event-loop
+	open := func() (net.Conn, int) {
+		c := dial(test, "tcp", rs.addr())
+		select {
+		case idx := <-es.opened:
+			return c, idx
+		case <-time.After(3 * time.Second):
+			test.Fatal("OnOpened was not called")
+		}
+		return nil, -1
+	}
+
+	// 连接数相同时选择下标较小的
+	conns := make([]net.Conn, 4)
+	for i := range conns {
+		c, idx := open()
+		defer c.Close()
+		if idx != i {
+			test.Fatalf("connection %d: expected loop %d, got %d", i, i, idx)
+		}
+		conns[i] = c
+	}
+
+	// 关闭event-loop 1上的连接之后它的连接数最少
+	_ = conns[1].Close()
+	select {
+	case idx := <-es.closed:
+		if idx != 1 {
+			test.Fatalf("expected the connection on loop 1 to be closed, got %d", idx)
+		}
+	case <-time.After(3 * time.Second):
+		test.Fatal("OnClosed was not called")
+	}
+	c, idx := open()
+	defer c.Close()
+	if idx != 1 {
+		test.Fatalf("expected loop 1, got %d", idx)
+	}
+}
+
+// 从指定的本地IP连接服务器，回环网卡上127.0.0.0/8的地址都可以使用
+func dialFrom(test *testing.T, localIP, addr string) net.Conn {
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		test.Fatal(err)
+	}
+	return c
+}
+
+func TestSourceAddrHashLoadBalancer(test *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		test.Skip("IPv6 is not available")
+	} else {
+		_ = ln.Close()
+	}
+
+	// 同时监听IPv4地址和双栈地址，IPv4客户端连接双栈地址时服务器看到的是IPv4-mapped IPv6地址
+	es := &loopIndexServer{opened: make(chan int, 32)}
+	rs := startMultiAddrServer(test, []string{"tcp4://127.0.0.1:0", "tcp://[::]:0"}, es, &core.Options{NumEventLoop: 8, LB: core.SourceAddrHash})
+	_, port, _ := net.SplitHostPort(rs.addrs[1].String())
+	addrs := []string{rs.addr(), rs.addr(), net.JoinHostPort("127.0.0.1", port)}
+
+	// 哈希值不依赖进程内的随机种子，重启之后同一个客户端仍然分配到同一个event-loop
+	expected := map[string]int{"127.0.0.1": 0, "127.0.0.2": 2, "127.0.0.3": 4, "127.0.0.4": 7}
+	for ip, loop := range expected {
+		for _, addr := range addrs {
+			c := dialFrom(test, ip, addr)
+			defer c.Close()
+			select {
+			case idx := <-es.opened:
+				if idx != loop {
+					test.Fatalf("%s via %s: expected loop %d, got %d", ip, addr, loop, idx)
+				}
+			case <-time.After(3 * time.Second):
+				test.Fatal("OnOpened was not called")
+			}
+		}
+	}
+
+	// 带端口时同一个IP的连接分散到不同的event-loop
+	es = &loopIndexServer{opened: make(chan int, 32)}
+	rs = startServer(test, "tcp://127.0.0.1:0", es, &core.Options{NumEventLoop: 8, LB: core.SourceAddrPortHash})
+	seen := make(map[int]bool)
+	for i := 0; i < 16; i++ {
+		c := dialFrom(test, "127.0.0.1", rs.addr())
+		defer c.Close()
+		select {
+		case idx := <-es.opened:
+			seen[idx] = true
+		case <-time.After(3 * time.Second):
+			test.Fatal("OnOpened was not called")
+		}
+	}
+	if len(seen) < 2 {
+		test.Fatal("connections from different ports should be spread across loops")
+	}
+}
+
+func TestLeastConnectionsBurst(test *testing.T) {
+	const numConn = 200
+	es := &loopIndexServer{opened: make(chan int, numConn)}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, &core.Options{NumEventLoop: 4, LB: core.LeastConnections})
+
+	// 大量连接同时到达，还没有注册完成的连接也要计入各个event-loop的连接数
+	var wg sync.WaitGroup
+	conns := make(chan net.Conn, numConn)
+	for i := 0; i < numConn; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c, err := net.Dial("tcp", rs.addr()); err == nil {
+				conns <- c
+			}
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	n := 0
+	for c := range conns {
+		defer c.Close()
+		n++
+	}
+	if n != numConn {
+		test.Fatalf("only %d of %d connections succeeded", n, numConn)
+	}
+
+	counts := make([]int, 4)
+	for i := 0; i < numConn; i++ {
+		select {
+		case idx := <-es.opened:
+			counts[idx]++
+		case <-time.After(3 * time.Second):
+			test.Fatalf("only %d connections were opened", i)
+		}
+	}
+	for _, n := range counts {
+		if n != numConn/4 {
+			test.Fatalf("connections should be spread evenly, got %v", counts)
+		}
+	}
+}
+
+func TestNumEventLoop(test *testing.T) {
+	lb := new(pinLoadBalancer)
+	opts := &core.Options{Multicore: true, NumEventLoop: 3, CustomLB: lb}
+	echoOnce(test, "tcp://127.0.0.1:0", opts)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.numLoop != 3 {
+		test.Fatalf("expected 3 event-loops, got %d", lb.numLoop)
+	}
+
+	// 加上主reactor锁定的线程超过了上限
+	s, err := core.NewServer(new(testServer), "tcp://127.0.0.1:0", &core.Options{NumEventLoop: 10000, LockOSThread: true})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err = s.Run(); err != errors.ErrTooManyEventLoopThreads {
+		test.Fatalf("expected ErrTooManyEventLoopThreads, got %v", err)
+	}
+}
+
+func TestTCPQuickAck(test *testing.T) {
+	// 每次读取数据之后重新开启TCP_QUICKACK
+	echoOnce(test, "tcp://127.0.0.1:0", &core.Options{TCPQuickAck: true})
+}
+
+func TestLinger(test *testing.T) {
+	// 关闭连接时直接发送RST
+	echoOnce(test, "tcp://127.0.0.1:0", &core.Options{Linger: -1})
+
+	s, err := core.NewServer(new(testServer), "tcp://127.0.0.1:0", &core.Options{Linger: time.Second})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err = s.Run(); err != errors.ErrPositiveLinger {
+		test.Fatalf("expected ErrPositiveLinger, got %v", err)
+	}
+}
+
+type affinityServer struct {
+	core.EventServer
+}
+
+// 回复当前线程可以使用的CPU数量
+func (es *affinityServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return []byte(err.Error()), core.Close
+	}
+	return []byte(strconv.Itoa(set.Count())), core.None
+}
+
+func TestCPUAffinity(test *testing.T) {
+	opts := &core.Options{NumEventLoop: 2, CPUAffinity: true}
+	rs := startServer(test, "tcp://127.0.0.1:0", new(affinityServer), opts)
+	if opts.LockOSThread {
+		test.Fatal("CPUAffinity should not modify the caller's Options")
+	}
+
+	for i := 0; i < 2; i++ {
+		c := dial(test, "tcp", rs.addr())
+		defer c.Close()
+		if _, err := c.Write([]byte("cpus")); err != nil {
+			test.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if string(buf[:n]) != "1" {
+			test.Fatalf("event-loop should be pinned to one cpu, got %q", buf[:n])
+		}
+	}
+}
+
+type tickServer struct {
+	core.EventServer
+	c     core.Conn
+	ticks int
+	err   error // 写入保存的连接时出现的意外错误
+}
+
+func (es *tickServer) OnOpened(c core.Conn) (out []byte, action core.Action) {
+	es.c = c
+	return
+}
+
+// 每次OnTick给客户端发送一个心跳包，发送3次之后关闭服务器
+func (es *tickServer) OnTick() (delay time.Duration, action core.Action) {
+	if es.c == nil {
+		return 10 * time.Millisecond, core.None
+	}
+	// 保存的连接可能已经被关闭，等待下一个连接
+	if err := es.c.Write([]byte("ping")); err != nil {
+		if err != errors.ErrConnectionClosed {
+			es.err = err
+		}
+		es.c = nil
+		return 10 * time.Millisecond, core.None
+	}
+	if es.ticks++; es.ticks == 3 {
+		return 0, core.Shutdown
+	}
+	return 50 * time.Millisecond, core.None
+}
+
+func TestServerTicker(test *testing.T) {
+	ts := new(tickServer)
+	rs := startServer(test, "tcp://127.0.0.1:0", ts, &core.Options{Ticker: true})
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	start := time.Now()
+	buf := make([]byte, 12)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		test.Fatal(err)
+	}
+	if string(buf) != "pingpingping" {
+		test.Fatalf("unexpected heartbeat: %q", buf)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		test.Fatalf("ticks fired too early: %v", elapsed)
+	}
+
+	// OnTick返回Shutdown之后服务器会自己关闭
+	if err := rs.wait(); err != nil {
+		test.Fatal(err)
+	}
+	if ts.err != nil {
+		test.Fatal(ts.err)
+	}
+	if ts.ticks != 3 {
+		test.Fatalf("expected 3 ticks, got %d", ts.ticks)
+	}
+}
+
+type timerServer struct {
+	core.EventServer
+}
+
+func (es *timerServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	c.AfterFunc(50*time.Millisecond, func() { _ = c.Write([]byte("a")) })
+	c.AfterFunc(20*time.Millisecond, func() { _ = c.Write([]byte("x")) }).Stop()
+	c.AfterFunc(100*time.Millisecond, func() {
+		_ = c.Write([]byte("b"))
+		c.AfterFunc(0, func() { _ = c.Write([]byte("c")) })
+	})
+	return
+}
+
+func TestConnAfterFunc(test *testing.T) {
+	rs := startServer(test, "tcp://127.0.0.1:0", new(timerServer), &core.Options{})
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	start := time.Now()
+	if _, err := c.Write([]byte("go")); err != nil {
+		test.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		test.Fatal(err)
+	}
+	if string(buf) != "abc" {
+		test.Fatalf("unexpected timer output: %q", buf)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		test.Fatalf("timers fired too early: %v", elapsed)
+	}
+}
+
+// 在OnOpened中把连接交给测试协程，由测试协程在event-loop之外调用AfterFunc
+type asyncTimerServer struct {
+	core.EventServer
+	conns chan core.Conn
+}
+
+func (es *asyncTimerServer) OnOpened(c core.Conn) (out []byte, action core.Action) {
+	es.conns <- c
+	return
+}
+
+func TestConnAfterFuncFromOtherGoroutine(test *testing.T) {
+	es := &asyncTimerServer{conns: make(chan core.Conn, 1)}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, &core.Options{})
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	var sc core.Conn
+	select {
+	case sc = <-es.conns:
+	case <-time.After(3 * time.Second):
+		test.Fatal("OnOpened was not called")
+	}
+
+	sc.AfterFunc(20*time.Millisecond, func() { _ = sc.Write([]byte("a")) })
+	if !sc.AfterFunc(10*time.Millisecond, func() { _ = sc.Write([]byte("x")) }).Stop() {
+		test.Fatal("expected to stop a pending timer")
+	}
+	buf := make([]byte, 1)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		test.Fatal(err)
+	}
+	if string(buf) != "a" {
+		test.Fatalf("unexpected timer output: %q", buf)
+	}
+
+	// event-loop退出之后加入的定时器不会执行
+	if err := rs.Stop(context.Background()); err != nil {
+		test.Fatal(err)
+	}
+	if err := rs.wait(); err != nil {
+		test.Fatal(err)
+	}
+	if sc.AfterFunc(0, func() {}).Stop() {
+		test.Fatal("timer added after shutdown should never run")
+	}
+}
+
+type idleServer struct {
+	core.EventServer
+	echo   bool
+	closed chan error
+}
+
+func (es *idleServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	if es.echo {
+		out = frame
+	}
+	return
+}
+
+func (es *idleServer) OnClosed(c core.Conn, err error) (action core.Action) {
+	es.closed <- err
+	return
+}
+
+// 客户端每隔interval发送一次数据，一共发送n次，然后等待服务器关闭连接
+func expectIdleClose(test *testing.T, es *idleServer, opts *core.Options, interval time.Duration, n int) time.Duration {
+	rs := startServer(test, "tcp://127.0.0.1:0", es, opts)
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if _, err := c.Write([]byte("ping")); err != nil {
+			test.Fatalf("connection closed too early after %v: %v", time.Since(start), err)
+		}
+		time.Sleep(interval)
+	}
+	select {
+	case err := <-es.closed:
+		if err != errors.ErrIdleTimeout {
+			test.Fatalf("expected ErrIdleTimeout, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		test.Fatal("idle connection was not closed")
+	}
+	return time.Since(start)
+}
+
+func TestIdleTimeout(test *testing.T) {
+	// 客户端一直在发送数据，连接不会因为空闲而被关闭
+	es := &idleServer{echo: true, closed: make(chan error, 1)}
+	if elapsed := expectIdleClose(test, es, &core.Options{IdleTimeout: 200 * time.Millisecond}, 50*time.Millisecond, 10); elapsed < 600*time.Millisecond {
+		test.Fatalf("connection closed after %v, should stay open while active", elapsed)
+	}
+
+	// 服务器只读不写，写空闲超时后关闭连接
+	es = &idleServer{closed: make(chan error, 1)}
+	if elapsed := expectIdleClose(test, es, &core.Options{WriteIdleTimeout: 200 * time.Millisecond}, 50*time.Millisecond, 3); elapsed > time.Second {
+		test.Fatalf("write idle connection closed too late: %v", elapsed)
+	}
+
+	// 客户端不发送数据，读空闲超时后关闭连接
+	es = &idleServer{closed: make(chan error, 1)}
+	if elapsed := expectIdleClose(test, es, &core.Options{ReadIdleTimeout: 200 * time.Millisecond}, 0, 0); elapsed < 200*time.Millisecond {
+		test.Fatalf("read idle connection closed too early: %v", elapsed)
+	}
+}
+
+// 空闲超时关闭连接时关闭服务器
+type idleShutdownServer struct {
+	core.EventServer
+}
+
+func (es *idleShutdownServer) OnClosed(c core.Conn, err error) (action core.Action) {
+	return core.Shutdown
+}
+
+func TestIdleTimeoutShutdown(test *testing.T) {
+	rs := startServer(test, "tcp://127.0.0.1:0", new(idleShutdownServer), &core.Options{IdleTimeout: 100 * time.Millisecond})
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	if err := rs.wait(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestIdleTimeoutWhileDraining(test *testing.T) {
+	bulk := &bulkServer{payload: make([]byte, 256*1024)}
+	opts := &core.Options{ShutdownTimeout: 10 * time.Second, IdleTimeout: 300 * time.Millisecond, SocketSendBuffer: smallSocketBuffer}
+	rs := startServer(test, "tcp://127.0.0.1:0", bulk, opts)
+
+	// 客户端不读取数据，连接在排空阶段因为空闲超时被关闭，不需要等到ShutdownTimeout
+	c := dialSmallRecvBuffer(test, rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("x")); err != nil {
+		test.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := rs.Stop(ctx); err != nil {
+		test.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		test.Fatalf("draining should finish once the idle connection is closed, took %v", elapsed)
+	}
+}
+
+type deadlineServer struct {
+	core.EventServer
+	payload   []byte
+	closed    chan error
+	writeErrs chan error
+}
+
+func (es *deadlineServer) OnOpened(c core.Conn) (out []byte, action core.Action) {
+	_ = c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	return
+}
+
+func (es *deadlineServer) React(frame []byte, c core.Conn) (out []byte, action core.Action) {
+	switch string(frame) {
+	case "keep":
+		// 取消读超时
+		_ = c.SetReadDeadline(time.Time{})
+		out = frame
+	case "bulk":
+		// 客户端不读取数据，积压的数据在写超时之前发送不完
+		_ = c.SetDeadline(time.Time{})
+		_ = c.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+		out = es.payload
+	case "late":
+		// 在event-loop中设置的超时立即生效，同一个回调中的Write会失败
+		_ = c.SetDeadline(time.Time{})
+		_ = c.SetWriteDeadline(time.Now())
+		es.writeErrs <- c.Write(frame)
+		_ = c.SetWriteDeadline(time.Time{})
+	case "expired":
+		// 写超时之后返回的数据发送失败，连接被关闭
+		_ = c.SetDeadline(time.Time{})
+		_ = c.SetWriteDeadline(time.Now())
+		out = frame
+	}
+	return
+}
+
+func (es *deadlineServer) OnClosed(c core.Conn, err error) (action core.Action) {
+	es.closed <- err
+	return
+}
+
+func TestConnDeadline(test *testing.T) {
+	es := &deadlineServer{payload: make([]byte, 256*1024), closed: make(chan error, 8), writeErrs: make(chan error, 1)}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, &core.Options{SocketSendBuffer: smallSocketBuffer})
+
+	expectClosed := func(what string) {
+		select {
+		case err := <-es.closed:
+			if err != os.ErrDeadlineExceeded {
+				test.Fatalf("%s: expected os.ErrDeadlineExceeded, got %v", what, err)
+			}
+		case <-time.After(3 * time.Second):
+			test.Fatalf("%s: connection was not closed", what)
+		}
+	}
+
+	// 读超时
+	c := dial(test, "tcp", rs.addr())
+	defer c.Close()
+	expectClosed("read deadline")
+
+	// 取消读超时后连接不会被关闭
+	c = dial(test, "tcp", rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("keep")); err != nil {
+		test.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		test.Fatal(err)
+	}
+	select {
+	case err := <-es.closed:
+		test.Fatalf("connection should stay open after clearing the deadline, closed with %v", err)
+	case <-time.After(400 * time.Millisecond):
+	}
+
+	// 写超时
+	c = dialSmallRecvBuffer(test, rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("bulk")); err != nil {
+		test.Fatal(err)
+	}
+	expectClosed("write deadline")
+
+	// 在React中设置已经过去的写超时
+	c = dial(test, "tcp", rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("late")); err != nil {
+		test.Fatal(err)
+	}
+	select {
+	case err := <-es.writeErrs:
+		if err != os.ErrDeadlineExceeded {
+			test.Fatalf("expected os.ErrDeadlineExceeded, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		test.Fatal("React was not called")
+	}
+
+	// 写超时之后React返回的数据
+	c = dial(test, "tcp", rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("expired")); err != nil {
+		test.Fatal(err)
+	}
+	expectClosed("write after deadline")
+}
+
+func TestConnDeadlineWhileDraining(test *testing.T) {
+	es := &deadlineServer{payload: make([]byte, 256*1024), closed: make(chan error, 1)}
+	opts := &core.Options{ShutdownTimeout: 10 * time.Second, SocketSendBuffer: smallSocketBuffer}
+	rs := startServer(test, "tcp://127.0.0.1:0", es, opts)
+
+	// 客户端不读取数据，连接在排空阶段因为写超时被关闭，不需要等到ShutdownTimeout
+	c := dialSmallRecvBuffer(test, rs.addr())
+	defer c.Close()
+	if _, err := c.Write([]byte("bulk")); err != nil {
+		test.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := rs.Stop(ctx); err != nil {
+		test.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		test.Fatalf("draining should finish once the connection hits its write deadline, took %v", elapsed)
+	}
+	if err := <-es.closed; err != os.ErrDeadlineExceeded {
+		test.Fatalf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
 }
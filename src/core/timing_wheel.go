@@ -0,0 +1,143 @@
+package core
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 时间轮中每一格代表的时长，也就是定时器的精度
+	timingWheelTick = time.Millisecond
+	// 时间轮的格数，必须是2的幂
+	timingWheelSlots = 1024
+	timingWheelMask  = timingWheelSlots - 1
+)
+
+// Timer 是Conn.AfterFunc返回的定时器
+type Timer interface {
+	// 取消定时器，线程安全，可以在其它协程中调用。定时器已经执行或者已经被取消时返回false
+	Stop() bool
+}
+
+const (
+	timerPending int32 = iota
+	timerFired
+	timerStopped
+)
+
+type timer struct {
+	state  int32
+	rounds int // 还需要转过多少圈才到期
+	fn     func() error
+	next   *timer
+}
+
+func (t *timer) Stop() bool {
+	return atomic.CompareAndSwapInt32(&t.state, timerPending, timerStopped)
+}
+
+type timerList struct {
+	head, tail *timer
+}
+
+func (l *timerList) push(t *timer) {
+	if l.tail == nil {
+		l.head = t
+	} else {
+		l.tail.next = t
+	}
+	l.tail = t
+}
+
+// 哈希时间轮，每个event-loop一个，定时器的回调在event-loop的线程中执行。
+// 只在event-loop的线程中访问，不需要加锁；取消定时器只是设置一个标记，等指针转到它所在的格子时再移除
+type timingWheel struct {
+	slots   [timingWheelSlots]timerList
+	due     [timingWheelSlots]int // 每个格子中在这一圈到期的定时器数量，只有这些格子需要唤醒event-loop
+	pos     int                   // 指针所在的格子
+	current time.Time             // 指针所在的格子对应的时间
+	count   int                   // 时间轮中的定时器数量，包括已经取消但还没有被移除的
+}
+
+// 添加一个d之后执行fn的定时器，fn返回的错误会交给event-loop处理，比如ErrServerShutdown会让event-loop退出
+func (tw *timingWheel) add(now time.Time, d time.Duration, fn func() error) *timer {
+	t := &timer{fn: fn}
+	tw.schedule(now, d, t)
+	return t
+}
+
+// 把已经创建好的定时器放进时间轮，用于在其它协程中创建、再投递到event-loop中加入的定时器
+func (tw *timingWheel) schedule(now time.Time, d time.Duration, t *timer) {
+	// 投递的过程中已经被取消了
+	if atomic.LoadInt32(&t.state) != timerPending {
+		return
+	}
+	if tw.count == 0 {
+		tw.current = now
+	}
+	// 指针可能落后于now，从指针所在的时间开始计算需要经过的格数
+	ticks := int((now.Sub(tw.current) + d + timingWheelTick - 1) / timingWheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t.rounds = (ticks - 1) / timingWheelSlots
+	pos := (tw.pos + ticks) & timingWheelMask
+	tw.slots[pos].push(t)
+	if t.rounds == 0 {
+		tw.due[pos]++
+	}
+	tw.count++
+}
+
+// 把指针拨到now，执行所有到期的定时器，返回距离下一个有定时器到期的格子的时长，没有定时器时返回-1。
+// 所有定时器都在一圈以后到期时返回转完一圈的时长，转完一圈之后再重新计算。
+// 定时器的回调返回错误时处理完当前格子就停下来，返回第一个错误
+func (tw *timingWheel) advance(now time.Time) (time.Duration, error) {
+	for tw.count > 0 && !now.Before(tw.current.Add(timingWheelTick)) {
+		tw.current = tw.current.Add(timingWheelTick)
+		tw.pos = (tw.pos + 1) & timingWheelMask
+		if err := tw.expire(tw.pos); err != nil {
+			return 0, err
+		}
+	}
+	if tw.count == 0 {
+		return -1, nil
+	}
+	i := 1
+	for ; i < timingWheelSlots; i++ {
+		if tw.due[(tw.pos+i)&timingWheelMask] > 0 {
+			break
+		}
+	}
+	return tw.current.Add(time.Duration(i) * timingWheelTick).Sub(now), nil
+}
+
+// 处理指针所在格子中的定时器，回调中新加入的定时器不会在这一轮被处理
+func (tw *timingWheel) expire(pos int) (err error) {
+	slot := &tw.slots[pos]
+	t := slot.head
+	slot.head, slot.tail = nil, nil
+	tw.due[pos] = 0
+	for t != nil {
+		next := t.next
+		t.next = nil
+		switch {
+		case atomic.LoadInt32(&t.state) == timerStopped:
+			tw.count--
+		case t.rounds > 0:
+			if t.rounds--; t.rounds == 0 {
+				tw.due[pos]++
+			}
+			slot.push(t)
+		default:
+			tw.count--
+			if atomic.CompareAndSwapInt32(&t.state, timerPending, timerFired) {
+				if ferr := t.fn(); ferr != nil && err == nil {
+					err = ferr
+				}
+			}
+		}
+		t = next
+	}
+	return
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"greactor/src/errors"
+	"testing"
+	"time"
+)
+
+// 时间轮的测试留在core包内：需要用构造出来的时间驱动advance，检查event-loop的休眠时长和时间轮内部的定时器数量，
+// 通过公开的API只能依赖真实的时间来观察，结果不稳定。通过Conn.AfterFunc的黑盒测试在test/server_test.go中
+func TestTimingWheel(test *testing.T) {
+	tw := new(timingWheel)
+	start := time.Now()
+	if delay, _ := tw.advance(start); delay != -1 {
+		test.Fatalf("empty wheel should not wake up the poller, got %v", delay)
+	}
+
+	var fired []int
+	add := func(i int, d time.Duration) *timer {
+		return tw.add(start, d, func() error {
+			fired = append(fired, i)
+			return nil
+		})
+	}
+	add(1, 5*time.Millisecond)
+	add(2, 5*time.Millisecond)
+	stopped := add(3, 10*time.Millisecond)
+	add(4, 3*time.Second) // 超过一圈
+	add(5, 0)
+
+	if delay, _ := tw.advance(start); delay != time.Millisecond {
+		test.Fatalf("expected next expiry in 1ms, got %v", delay)
+	}
+	if !stopped.Stop() || stopped.Stop() {
+		test.Fatal("Stop should only succeed once")
+	}
+
+	if delay, _ := tw.advance(start.Add(5 * time.Millisecond)); delay != 5*time.Millisecond {
+		test.Fatalf("expected next expiry in 5ms, got %v", delay)
+	}
+	if len(fired) != 3 || fired[0] != 5 || fired[1] != 1 || fired[2] != 2 {
+		test.Fatalf("unexpected fired timers: %v", fired)
+	}
+
+	tw.advance(start.Add(2999 * time.Millisecond))
+	if len(fired) != 3 {
+		test.Fatalf("timer fired too early: %v", fired)
+	}
+	if delay, _ := tw.advance(start.Add(3 * time.Second)); delay != -1 || tw.count != 0 {
+		test.Fatalf("all timers should be removed, delay=%v count=%d", delay, tw.count)
+	}
+	if len(fired) != 4 || fired[3] != 4 {
+		test.Fatalf("unexpected fired timers: %v", fired)
+	}
+}
+
+func TestTimingWheelAddInCallback(test *testing.T) {
+	tw := new(timingWheel)
+	now := time.Now()
+	n := 0
+	var fn func() error
+	fn = func() error {
+		if n++; n < 3 {
+			tw.add(now, 0, fn)
+		}
+		return nil
+	}
+	tw.add(now, 0, fn)
+	for i := 1; i <= 3; i++ {
+		now = now.Add(time.Millisecond)
+		tw.advance(now)
+		if n != i {
+			test.Fatalf("expected %d calls after %d ticks, got %d", i, i, n)
+		}
+	}
+	if tw.count != 0 {
+		test.Fatalf("expected empty wheel, got %d timers", tw.count)
+	}
+}
+
+func TestTimingWheelFarFutureDelay(test *testing.T) {
+	tw := new(timingWheel)
+	start := time.Now()
+	tw.add(start, 10*time.Second, func() error { return nil })
+	tw.add(start, 3*time.Second, func() error { return nil })
+
+	// 只有一圈以后才到期的定时器时，不需要每个格子都唤醒一次event-loop
+	revolution := timingWheelSlots * timingWheelTick
+	if delay, _ := tw.advance(start); delay != revolution {
+		test.Fatalf("expected to sleep a whole revolution, got %v", delay)
+	}
+	now := start.Add(revolution)
+	if delay, _ := tw.advance(now); delay != revolution {
+		test.Fatalf("expected to sleep a whole revolution, got %v", delay)
+	}
+
+	// 转到3秒的定时器所在的那一圈时，直接等到它到期
+	now = start.Add(2 * revolution)
+	if delay, _ := tw.advance(now); delay != start.Add(3*time.Second).Sub(now) {
+		test.Fatalf("expected next expiry at 3s, got %v", delay)
+	}
+	tw.add(now, 100*time.Millisecond, func() error { return nil })
+	if delay, _ := tw.advance(now); delay != 100*time.Millisecond {
+		test.Fatalf("expected next expiry in 100ms, got %v", delay)
+	}
+}
+
+// 回调返回错误时在哪个格子停下来只能在包内用构造出来的时间检查，错误交给poller之后让服务器退出的行为
+// 由test/server_test.go中的TestIdleTimeoutShutdown覆盖
+func TestTimingWheelCallbackError(test *testing.T) {
+	tw := new(timingWheel)
+	start := time.Now()
+	fired := 0
+	tw.add(start, time.Millisecond, func() error { return errors.ErrServerShutdown })
+	tw.add(start, time.Millisecond, func() error {
+		fired++
+		return nil
+	})
+	tw.add(start, 2*time.Millisecond, func() error {
+		fired++
+		return nil
+	})
+
+	// 同一个格子中的定时器都会执行，之后的格子留到下一次
+	if _, err := tw.advance(start.Add(2 * time.Millisecond)); err != errors.ErrServerShutdown {
+		test.Fatalf("expected ErrServerShutdown, got %v", err)
+	}
+	if fired != 1 || tw.count != 1 {
+		test.Fatalf("expected 1 fired and 1 pending timer, got %d and %d", fired, tw.count)
+	}
+	if _, err := tw.advance(start.Add(2 * time.Millisecond)); err != nil || fired != 2 {
+		test.Fatalf("expected the remaining timer to fire, fired=%d err=%v", fired, err)
+	}
+}
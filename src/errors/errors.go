@@ -7,12 +7,16 @@ var (
 	ErrServerShutdown = errors.New("server is going to be shutdown")
 	// ErrServerInShutdown occurs when attempting to shut the server down more than once.
 	ErrServerInShutdown = errors.New("server is already in shutdown")
+	// ErrServerNotFound occurs when stopping a server by an address that no running server listens on.
+	ErrServerNotFound = errors.New("no server is listening on the address")
 	// ErrAcceptSocket occurs when acceptor does not accept the new connection properly.
 	ErrAcceptSocket = errors.New("accept a new connection error")
 	// ErrTooManyEventLoopThreads occurs when attempting to set up more than 10,000 events-loop goroutines under LockOSThread mode.
 	ErrTooManyEventLoopThreads = errors.New("too many events-loops under LockOSThread mode")
 	// ErrUnsupportedProtocol occurs when trying to use protocol that is not supported.
 	ErrUnsupportedProtocol = errors.New("only unix, tcp/tcp4/tcp6, udp/udp4/udp6 are supported")
+	// ErrNoAddresses occurs when creating a server without any address to listen on.
+	ErrNoAddresses = errors.New("no address to listen on")
 	// ErrUnsupportedTCPProtocol occurs when trying to use an unsupported TCP protocol.
 	ErrUnsupportedTCPProtocol = errors.New("only tcp/tcp4/tcp6 are supported")
 	// ErrUnsupportedUDPProtocol occurs when trying to use an unsupported UDP protocol.
@@ -23,6 +27,10 @@ var (
 	ErrUnsupportedPlatform = errors.New("unsupported platform in gnet")
 	// ErrConnectionClosed occurs when the events-loop receives a closed connection.
 	ErrConnectionClosed = errors.New("connection is closed")
+	// ErrPositiveLinger occurs when Options.Linger is positive, which would block the event-loop on close.
+	ErrPositiveLinger = errors.New("positive linger is not supported, it blocks the event-loop on close")
+	// ErrIdleTimeout occurs when a connection is closed because it has been idle for too long.
+	ErrIdleTimeout = errors.New("connection idle timeout")
 
 	// ================================================= icodecs errors =================================================.
 
@@ -36,4 +44,8 @@ var (
 	ErrUnsupportedLength = errors.New("unsupported lengthFieldLength. (expected: 1, 2, 3, 4, or 8)")
 	// ErrTooLessLength occurs when adjusted frame length is less than zero.
 	ErrTooLessLength = errors.New("adjusted frame length is less than zero")
+	// ErrTooLongFrame occurs when the frame length exceeds the max frame length.
+	ErrTooLongFrame = errors.New("frame length exceeds the max frame length")
+	// ErrLengthFieldOverflow occurs when the frame length does not fit into the length field.
+	ErrLengthFieldOverflow = errors.New("frame length does not fit into the length field")
 )
\ No newline at end of file
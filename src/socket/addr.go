@@ -5,6 +5,7 @@ import (
 	"greactor/src/buffers"
 	"greactor/src/errors"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -14,7 +15,8 @@ type ServerAddr struct {
 	NetAddr net.Addr
 	Address string
 	Network string
-	Family  int // 协议族
+	Family  int  // 协议族
+	V6Only  bool // 是否只接收IPv6的连接，这样才能和监听同一端口的IPv4地址共存
 }
 
 var ipv4AddrPool = sync.Pool{New: func() interface{} {
@@ -37,15 +39,50 @@ func PutIpv4AddrByteBuffer(bb *buffers.ByteBuffer) {
 
 func ParseProtoAddr(addr string) (network, address string) {
 	network = "tcp"
-	address = strings.ToLower(addr)
+	address = addr
 	if strings.Contains(address, "://") {
-		pair := strings.Split(address, "://")
-		network = pair[0]
+		pair := strings.SplitN(address, "://", 2)
+		// unix socket的路径是区分大小写的，只能把协议转为小写
+		network = strings.ToLower(pair[0])
 		address = pair[1]
 	}
 	return
 }
 
+// 根据协议和地址解析出服务器需要监听的地址
+func ResolveServerAddr(network, address string) (*ServerAddr, error) {
+	var (
+		sa      unix.Sockaddr
+		family  int
+		netAddr net.Addr
+		err     error
+	)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		var tcpAddr *net.TCPAddr
+		if sa, family, tcpAddr, _, err = GetTCPSockAddr(network, address); err == nil {
+			netAddr = tcpAddr
+		}
+	case "udp", "udp4", "udp6":
+		var udpAddr *net.UDPAddr
+		if sa, family, udpAddr, _, err = GetUDPSockAddr(network, address); err == nil {
+			netAddr = udpAddr
+		}
+	case "unix":
+		var unixAddr *net.UnixAddr
+		if sa, family, unixAddr, err = GetUnixSockAddr(network, address); err == nil {
+			netAddr = unixAddr
+		}
+	default:
+		err = errors.ErrUnsupportedProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	v6only := family == unix.AF_INET6 && (network == "tcp6" || network == "udp6")
+	return &ServerAddr{Sa: sa, NetAddr: netAddr, Address: address, Family: family, Network: network, V6Only: v6only}, nil
+}
+
 func GetTCPSockAddr(proto, addr string) (sa unix.Sockaddr, family int, tcpAddr *net.TCPAddr, ipv6only bool, err error) {
 	var tcpVersion string
 
@@ -120,17 +157,177 @@ func determineTCPProto(proto string, addr *net.TCPAddr) (string, error) {
 	return "", errors.ErrUnsupportedTCPProtocol
 }
 
+func GetUDPSockAddr(proto, addr string) (sa unix.Sockaddr, family int, udpAddr *net.UDPAddr, ipv6only bool, err error) {
+	var udpVersion string
+
+	udpAddr, err = net.ResolveUDPAddr(proto, addr)
+	if err != nil {
+		return
+	}
+
+	udpVersion, err = determineUDPProto(proto, udpAddr)
+	if err != nil {
+		return
+	}
+
+	switch udpVersion {
+	case "udp4":
+		sa4 := &unix.SockaddrInet4{Port: udpAddr.Port}
+
+		if udpAddr.IP != nil {
+			if len(udpAddr.IP) == 16 {
+				copy(sa4.Addr[:], udpAddr.IP[12:16]) // copy last 4 bytes of slice to array
+			} else {
+				copy(sa4.Addr[:], udpAddr.IP) // copy all bytes of slice to array
+			}
+		}
+
+		sa, family = sa4, unix.AF_INET
+	case "udp6":
+		ipv6only = true
+		fallthrough
+	case "udp":
+		sa6 := &unix.SockaddrInet6{Port: udpAddr.Port}
+
+		if udpAddr.IP != nil {
+			copy(sa6.Addr[:], udpAddr.IP) // copy all bytes of slice to array
+		}
+
+		if udpAddr.Zone != "" {
+			var iface *net.Interface
+			iface, err = net.InterfaceByName(udpAddr.Zone)
+			if err != nil {
+				return
+			}
+
+			sa6.ZoneId = uint32(iface.Index)
+		}
+
+		sa, family = sa6, unix.AF_INET6
+	default:
+		err = errors.ErrUnsupportedProtocol
+	}
+
+	return
+}
+
+// 根据ip判断具体的udp协议
+func determineUDPProto(proto string, addr *net.UDPAddr) (string, error) {
+	// 尝试将ip转为IPV4地址
+	if addr.IP.To4() != nil {
+		return "udp4", nil
+	}
+
+	// 尝试将ip转为IPV6地址
+	if addr.IP.To16() != nil {
+		return "udp6", nil
+	}
+
+	switch proto {
+	case "udp", "udp4", "udp6":
+		return proto, nil
+	}
+
+	return "", errors.ErrUnsupportedUDPProtocol
+}
+
+func GetUnixSockAddr(proto, addr string) (sa unix.Sockaddr, family int, unixAddr *net.UnixAddr, err error) {
+	if proto != "unix" {
+		err = errors.ErrUnsupportedUDSProtocol
+		return
+	}
+
+	unixAddr, err = net.ResolveUnixAddr(proto, addr)
+	if err != nil {
+		return
+	}
+
+	sa, family = &unix.SockaddrUnix{Name: unixAddr.Name}, unix.AF_UNIX
+	return
+}
+
+// 将数据报的来源地址转换为net.UDPAddr
+func SockaddrToUDPAddr(sa unix.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		ip := sockaddrInet4ToIP(sa)
+		return &net.UDPAddr{IP: ip, Port: sa.Port}
+	case *unix.SockaddrInet6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: sa.Port, Zone: ip6ZoneToString(sa.ZoneId)}
+	}
+	return nil
+}
+
 func SockaddrToTCPOrUnixAddr(sa unix.Sockaddr) net.Addr {
 	switch sa := sa.(type) {
 	case *unix.SockaddrInet4:
 		ip := sockaddrInet4ToIP(sa)
 		return &net.TCPAddr{IP: ip, Port: sa.Port}
+	case *unix.SockaddrInet6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.TCPAddr{IP: ip, Port: sa.Port, Zone: ip6ZoneToString(sa.ZoneId)}
 	case *unix.SockaddrUnix:
 		return &net.UnixAddr{Name: sa.Name, Net: "unix"}
 	}
 	return nil
 }
 
+// 将net.Addr转换为unix.Sockaddr和对应的协议族，用于主动连接对端
+func NetAddrToSockaddr(addr net.Addr) (sa unix.Sockaddr, family int, err error) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		sa, family = ipToSockaddr(addr.IP, addr.Port, addr.Zone)
+	case *net.UDPAddr:
+		sa, family = ipToSockaddr(addr.IP, addr.Port, addr.Zone)
+	case *net.UnixAddr:
+		sa, family = &unix.SockaddrUnix{Name: addr.Name}, unix.AF_UNIX
+	default:
+		err = errors.ErrUnsupportedProtocol
+	}
+	return
+}
+
+// IPv4地址(包括映射到IPv6中的IPv4地址)转换为SockaddrInet4，其它的都转换为SockaddrInet6
+func ipToSockaddr(ip net.IP, port int, zone string) (unix.Sockaddr, int) {
+	if ip4 := ip.To4(); ip4 != nil && zone == "" {
+		sa4 := &unix.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		return sa4, unix.AF_INET
+	}
+
+	sa6 := &unix.SockaddrInet6{Port: port, ZoneId: ip6ZoneToInt(zone)}
+	if ip6 := ip.To16(); ip6 != nil {
+		copy(sa6.Addr[:], ip6)
+	}
+	return sa6, unix.AF_INET6
+}
+
+// 将IPv6的zone id转换为网卡名，找不到对应的网卡时使用数字形式
+func ip6ZoneToString(zone uint32) string {
+	if zone == 0 {
+		return ""
+	}
+	if iface, err := net.InterfaceByIndex(int(zone)); err == nil {
+		return iface.Name
+	}
+	return strconv.FormatUint(uint64(zone), 10)
+}
+
+// 将网卡名或者数字形式的zone转换为IPv6的zone id，无法识别时返回0
+func ip6ZoneToInt(zone string) uint32 {
+	if zone == "" {
+		return 0
+	}
+	if iface, err := net.InterfaceByName(zone); err == nil {
+		return uint32(iface.Index)
+	}
+	n, _ := strconv.ParseUint(zone, 10, 32)
+	return uint32(n)
+}
+
 func sockaddrInet4ToIP(sa *unix.SockaddrInet4) net.IP {
 	ip := GetIpv4AddrByteBuffer().B
 	// V4InV6Prefix
@@ -1,8 +1,109 @@
 package socket
 
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
 // Option is used for setting an option on socket.
 type Option struct {
 	SetSockOpt func(int, int) error
 	Opt        int
 }
 
+// 设置TCP_NODELAY，noDelay为1时关闭Nagle算法，小数据包会被立即发送
+func SetNoDelay(fd, noDelay int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, noDelay))
+}
+
+// 开启SO_KEEPALIVE，连接空闲secs秒之后开始发送保活探测包，之后每隔secs秒发送一次
+func SetKeepAlivePeriod(fd, secs int) error {
+	if secs <= 0 {
+		return os.NewSyscallError("setsockopt", unix.EINVAL)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, secs); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, secs))
+}
+
+// 设置SO_RCVBUF，socket接收缓冲区的大小
+func SetRecvBuffer(fd, size int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, size))
+}
+
+// 设置SO_SNDBUF，socket发送缓冲区的大小
+func SetSendBuffer(fd, size int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, size))
+}
+
+// 设置SO_REUSEADDR，允许绑定处于TIME_WAIT状态的地址
+func SetReuseAddr(fd, reuseAddr int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, reuseAddr))
+}
+
+// 设置SO_LINGER，sec小于0时关闭SO_LINGER；否则关闭socket时最多阻塞sec秒等待数据发送完毕，
+// sec为0时关闭socket会丢弃未发送的数据并直接发送RST
+func SetLinger(fd, sec int) error {
+	var l unix.Linger
+	if sec >= 0 {
+		l.Onoff = 1
+		l.Linger = int32(sec)
+	}
+	return os.NewSyscallError("setsockopt", unix.SetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER, &l))
+}
+
+// 设置SO_REUSEPORT，允许多个socket绑定同一个地址，由内核在它们之间做负载均衡
+func SetReusePort(fd, reusePort int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, reusePort))
+}
+
+// 设置TCP_FASTOPEN，qlen为监听socket上尚未完成三次握手的TFO请求队列的长度
+func SetFastOpen(fd, qlen int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, qlen))
+}
+
+// 设置TCP_DEFER_ACCEPT，监听socket在连接上有数据到达(最多等待secs秒)时才唤醒accept
+func SetDeferAccept(fd, secs int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, secs))
+}
+
+// 设置TCP_USER_TIMEOUT，已发送的数据超过msecs毫秒仍未被确认时内核会关闭连接
+func SetUserTimeout(fd, msecs int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, msecs))
+}
+
+// 设置TCP_QUICKACK，quickAck为1时立即发送ACK而不是延迟确认
+func SetQuickAck(fd, quickAck int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_QUICKACK, quickAck))
+}
+
+// 设置IPv4 socket的IP_TOS，可以用来做DSCP标记
+func SetTOS(fd, tos int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos))
+}
+
+// 设置IPv6 socket的IPV6_TCLASS，作用和IPv4的IP_TOS一样
+func SetTrafficClass(fd, tclass int) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tclass))
+}
+
+// 设置SO_BINDTODEVICE，socket只在名为ifname的网卡上收发数据，需要CAP_NET_RAW权限
+func SetBindToDevice(fd int, ifname string) error {
+	return os.NewSyscallError("setsockopt", unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifname))
+}
+
+// 根据监听地址设置IPV6_V6ONLY，只对IPv6的socket有效
+func setV6Only(fd int, addr *ServerAddr) error {
+	if addr.Family != unix.AF_INET6 {
+		return nil
+	}
+	v6only := 0
+	if addr.V6Only {
+		v6only = 1
+	}
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v6only))
+}
@@ -0,0 +1,62 @@
+package test
+
+import (
+	"golang.org/x/sys/unix"
+	"greactor/src/socket"
+	"net"
+	"testing"
+)
+
+func TestSockaddrInet6ToTCPAddr(test *testing.T) {
+	sa := &unix.SockaddrInet6{Port: 9000}
+	copy(sa.Addr[:], net.ParseIP("2001:db8::1"))
+	addr, ok := socket.SockaddrToTCPOrUnixAddr(sa).(*net.TCPAddr)
+	if !ok {
+		test.Fatalf("expected *net.TCPAddr, got %T", addr)
+	}
+	if addr.String() != "[2001:db8::1]:9000" {
+		test.Fatalf("unexpected address: %s", addr)
+	}
+
+	// zone id会被转换为网卡名，找不到网卡时使用数字形式
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		test.Skip("loopback interface is unavailable")
+	}
+	sa.ZoneId = uint32(lo.Index)
+	if addr = socket.SockaddrToTCPOrUnixAddr(sa).(*net.TCPAddr); addr.Zone != "lo" {
+		test.Fatalf("unexpected zone: %q", addr.Zone)
+	}
+	sa.ZoneId = 1 << 30
+	if addr = socket.SockaddrToTCPOrUnixAddr(sa).(*net.TCPAddr); addr.Zone != "1073741824" {
+		test.Fatalf("unexpected zone: %q", addr.Zone)
+	}
+}
+
+func TestNetAddrToSockaddr(test *testing.T) {
+	sa, family, err := socket.NetAddrToSockaddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if sa4, ok := sa.(*unix.SockaddrInet4); !ok || family != unix.AF_INET || sa4.Port != 80 || sa4.Addr != [4]byte{127, 0, 0, 1} {
+		test.Fatalf("unexpected sockaddr: %#v", sa)
+	}
+
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 53, Zone: "lo"}
+	if sa, family, err = socket.NetAddrToSockaddr(udpAddr); err != nil {
+		test.Fatal(err)
+	}
+	if _, ok := sa.(*unix.SockaddrInet6); !ok || family != unix.AF_INET6 {
+		test.Fatalf("unexpected sockaddr: %#v", sa)
+	}
+	if back := socket.SockaddrToUDPAddr(sa); back.String() != udpAddr.String() {
+		test.Fatalf("round trip mismatch: %s != %s", back, udpAddr)
+	}
+
+	if sa, family, err = socket.NetAddrToSockaddr(&net.UnixAddr{Name: "/tmp/greactor.sock", Net: "unix"}); err != nil {
+		test.Fatal(err)
+	}
+	if sau, ok := sa.(*unix.SockaddrUnix); !ok || family != unix.AF_UNIX || sau.Name != "/tmp/greactor.sock" {
+		test.Fatalf("unexpected sockaddr: %#v", sa)
+	}
+}
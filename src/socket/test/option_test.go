@@ -0,0 +1,76 @@
+package test
+
+import (
+	"golang.org/x/sys/unix"
+	"greactor/src/socket"
+	"testing"
+)
+
+func TestSocketOptions(test *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer unix.Close(fd)
+
+	intOpts := []struct {
+		name        string
+		set         func(int, int) error
+		level, opt  int
+		value, want int
+	}{
+		{"TCP_NODELAY", socket.SetNoDelay, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1, 1},
+		{"SO_REUSEADDR", socket.SetReuseAddr, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1, 1},
+		{"SO_REUSEPORT", socket.SetReusePort, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1, 1},
+		{"TCP_KEEPIDLE", socket.SetKeepAlivePeriod, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 30, 30},
+		{"TCP_FASTOPEN", socket.SetFastOpen, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, 128, 128},
+		{"TCP_USER_TIMEOUT", socket.SetUserTimeout, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 5000, 5000},
+		{"IP_TOS", socket.SetTOS, unix.IPPROTO_IP, unix.IP_TOS, 0x10, 0x10},
+	}
+	for _, o := range intOpts {
+		if err = o.set(fd, o.value); err != nil {
+			test.Fatalf("%s: %v", o.name, err)
+		}
+		if v, err := unix.GetsockoptInt(fd, o.level, o.opt); err != nil || v != o.want {
+			test.Fatalf("%s: expected %d, got %d (%v)", o.name, o.want, v, err)
+		}
+	}
+	if v, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE); v != 1 {
+		test.Fatal("SO_KEEPALIVE should be enabled")
+	}
+
+	// 内核会把缓冲区的大小翻倍，只检查设置生效
+	if err = socket.SetRecvBuffer(fd, 64*1024); err != nil {
+		test.Fatal(err)
+	}
+	if v, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF); v < 64*1024 {
+		test.Fatalf("unexpected SO_RCVBUF: %d", v)
+	}
+	if err = socket.SetSendBuffer(fd, 64*1024); err != nil {
+		test.Fatal(err)
+	}
+	if v, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF); v < 64*1024 {
+		test.Fatalf("unexpected SO_SNDBUF: %d", v)
+	}
+
+	if err = socket.SetLinger(fd, 5); err != nil {
+		test.Fatal(err)
+	}
+	if l, err := unix.GetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER); err != nil || l.Onoff != 1 || l.Linger != 5 {
+		test.Fatalf("unexpected SO_LINGER: %+v (%v)", l, err)
+	}
+}
+
+func TestIPv6TrafficClass(test *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	if err != nil {
+		test.Skip("IPv6 not supported:", err)
+	}
+	defer unix.Close(fd)
+	if err = socket.SetTrafficClass(fd, 0x20); err != nil {
+		test.Fatal(err)
+	}
+	if v, err := unix.GetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS); err != nil || v != 0x20 {
+		test.Fatalf("expected IPV6_TCLASS 0x20, got %d (%v)", v, err)
+	}
+}
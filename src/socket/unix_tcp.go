@@ -5,14 +5,15 @@ import (
 	"os"
 )
 
-// backlog参数的最大值
+// backlog参数的默认值
 var listenerBacklogMaxSize = unix.SOMAXCONN
 
-func TCPSocket(addr *ServerAddr, passive bool, sockOpts ...Option) (int, error) {
-	return tcpSocket(addr, passive, sockOpts...)
+// 创建TCP socket，passive为true时监听addr，backlog为监听队列的长度，不大于0时使用默认值；否则连接到addr
+func TCPSocket(addr *ServerAddr, passive bool, backlog int, sockOpts ...Option) (int, error) {
+	return tcpSocket(addr, passive, backlog, sockOpts...)
 }
 
-func tcpSocket(addr *ServerAddr, passive bool, sockOpts ...Option) (fd int, err error) {
+func tcpSocket(addr *ServerAddr, passive bool, backlog int, sockOpts ...Option) (fd int, err error) {
 
 	if fd, err = sysSocket(addr.Family, unix.SOCK_STREAM, unix.IPPROTO_TCP); err != nil {
 		err = os.NewSyscallError("socket", err)
@@ -24,6 +25,10 @@ func tcpSocket(addr *ServerAddr, passive bool, sockOpts ...Option) (fd int, err
 		}
 	}()
 
+	if err = setV6Only(fd, addr); err != nil {
+		return
+	}
+
 	for _, sockOpt := range sockOpts {
 		if err = sockOpt.SetSockOpt(fd, sockOpt.Opt); err != nil {
 			return
@@ -35,7 +40,7 @@ func tcpSocket(addr *ServerAddr, passive bool, sockOpts ...Option) (fd int, err
 	}
 
 	if passive {
-		err = os.NewSyscallError("listen", unix.Listen(fd, listenerBacklogMaxSize))
+		err = os.NewSyscallError("listen", unix.Listen(fd, listenBacklog(backlog)))
 	} else {
 		err = os.NewSyscallError("connect", unix.Connect(fd, addr.Sa))
 	}
@@ -43,6 +48,14 @@ func tcpSocket(addr *ServerAddr, passive bool, sockOpts ...Option) (fd int, err
 	return
 }
 
+// 获取listen时使用的backlog参数
+func listenBacklog(backlog int) int {
+	if backlog <= 0 {
+		return listenerBacklogMaxSize
+	}
+	return backlog
+}
+
 func sysSocket(family, sotype, proto int) (int, error) {
 	return unix.Socket(family, sotype|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, proto)
 }
@@ -0,0 +1,47 @@
+package socket
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// 创建UDP socket，connect为true时会把socket连接到addr，否则绑定到addr上
+func UDPSocket(addr *ServerAddr, connect bool, sockOpts ...Option) (int, error) {
+	return udpSocket(addr, connect, sockOpts...)
+}
+
+func udpSocket(addr *ServerAddr, connect bool, sockOpts ...Option) (fd int, err error) {
+
+	if fd, err = sysSocket(addr.Family, unix.SOCK_DGRAM, unix.IPPROTO_UDP); err != nil {
+		err = os.NewSyscallError("socket", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = unix.Close(fd)
+		}
+	}()
+
+	if err = setV6Only(fd, addr); err != nil {
+		return
+	}
+
+	// 和标准库一样，默认允许发送广播数据报
+	if err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BROADCAST, 1)); err != nil {
+		return
+	}
+
+	for _, sockOpt := range sockOpts {
+		if err = sockOpt.SetSockOpt(fd, sockOpt.Opt); err != nil {
+			return
+		}
+	}
+
+	if connect {
+		err = os.NewSyscallError("connect", unix.Connect(fd, addr.Sa))
+	} else {
+		err = os.NewSyscallError("bind", unix.Bind(fd, addr.Sa))
+	}
+
+	return
+}
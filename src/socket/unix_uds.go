@@ -0,0 +1,87 @@
+package socket
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+)
+
+// 创建unix domain socket，passive为true时监听addr，否则连接到addr。
+// 监听时会先清理掉上次进程异常退出时遗留的socket文件，perm不为0时会把socket文件的权限修改为perm，
+// backlog为监听队列的长度，不大于0时使用默认值
+func UnixSocket(addr *ServerAddr, passive bool, perm os.FileMode, backlog int, sockOpts ...Option) (int, error) {
+	return udsSocket(addr, passive, perm, backlog, sockOpts...)
+}
+
+func udsSocket(addr *ServerAddr, passive bool, perm os.FileMode, backlog int, sockOpts ...Option) (fd int, err error) {
+
+	if fd, err = sysSocket(addr.Family, unix.SOCK_STREAM, 0); err != nil {
+		err = os.NewSyscallError("socket", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = unix.Close(fd)
+		}
+	}()
+
+	for _, sockOpt := range sockOpts {
+		if err = sockOpt.SetSockOpt(fd, sockOpt.Opt); err != nil {
+			return
+		}
+	}
+
+	if !passive {
+		err = os.NewSyscallError("connect", unix.Connect(fd, addr.Sa))
+		return
+	}
+
+	if err = removeStaleUnixSocket(addr); err != nil {
+		return
+	}
+	if err = os.NewSyscallError("bind", unix.Bind(fd, addr.Sa)); err != nil {
+		return
+	}
+	if perm != 0 && !IsAbstractUnixAddr(addr.Address) {
+		if err = os.Chmod(addr.Address, perm); err != nil {
+			return
+		}
+	}
+	err = os.NewSyscallError("listen", unix.Listen(fd, listenBacklog(backlog)))
+
+	return
+}
+
+// 以'@'开头的地址位于Linux的抽象命名空间中，不会在文件系统中创建socket文件
+func IsAbstractUnixAddr(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// 删除上次进程异常退出时遗留下来的socket文件，如果还有其它进程在这个socket上监听，就不能删除它
+func removeStaleUnixSocket(addr *ServerAddr) error {
+	if IsAbstractUnixAddr(addr.Address) {
+		return nil
+	}
+
+	fi, err := os.Lstat(addr.Address)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return os.NewSyscallError("bind", unix.EADDRINUSE)
+	}
+
+	// 尝试连接这个socket，只有连接被拒绝才说明没有进程在监听
+	fd, err := sysSocket(addr.Family, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(fd)
+	if err = unix.Connect(fd, addr.Sa); err != unix.ECONNREFUSED {
+		return os.NewSyscallError("bind", unix.EADDRINUSE)
+	}
+	return os.Remove(addr.Address)
+}